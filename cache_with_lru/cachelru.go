@@ -14,26 +14,37 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
 // CacheEntry represents a HTTP cache entry
+// The body itself lives in the blob store; the metadata record written to
+// disk only keeps its hash and size, so identical bodies are stored once
 type CacheEntry struct {
-	Body         []byte      // The http response body
-	Header       http.Header // The http response headers
-	StatusCode   int         // The http response status code
-	MaxAge       int64       // Max age of the cache file
-	LastModified string      // Last modified date of the cache file
-	CreationTime time.Time   // Time when the cache file is created
+	Body          []byte      // The http response body
+	Header        http.Header // The http response headers
+	StatusCode    int         // The http response status code
+	MaxAge        int64       // Max age of the cache file
+	LastModified  string      // Last modified date of the cache file
+	CreationTime  time.Time   // Time when the cache file is created
+	BodyHash      string      // SHA-256 of the body, naming its blob
+	BodySize      int64       // Length of the body in bytes
+	URL           string      // The requested URL
+	RequestHeader http.Header // The http request headers sent to the origin
 
 }
 
 // HTTPCache defines the structure for an HTTP cache
 // cacheDir holds the directory path where the cache is stored
 // The key is the hash value of the URL string,
-// and the value is a slice of bytes representing the cached response body
+// and the value is the metadata record of the cached response
+// Response bodies are kept in blobs, a content-addressed store under cacheDir
 type HTTPCache struct {
 	cacheDir    string
+	blobs       *blobStore
+	stats       *cacheStats
+	mu          sync.Mutex // Serializes replacing and removing metadata records, and guards the fields below
 	lruQueue    *list.List
 	currentSize int
 	maxCap      int
@@ -42,12 +53,29 @@ type HTTPCache struct {
 
 // Creates a HTTPCache object
 func NewHTTPCache() *HTTPCache {
-	cacheDir := "./http_cache" // Set the cache directory name
+	return newHTTPCacheAt("./http_cache") // Set the cache directory name
+}
+
+// newHTTPCacheAt creates a HTTPCache stored in cacheDir
+func newHTTPCacheAt(cacheDir string) *HTTPCache {
 	// Create the cache directroy with permission to be fully accessible by user
 	os.MkdirAll(cacheDir, os.ModePerm)
+	// Records are written to tmp and renamed into place; anything left
+	// there was cut short by a crash
+	os.RemoveAll(filepath.Join(cacheDir, "tmp"))
+	os.MkdirAll(filepath.Join(cacheDir, "tmp"), os.ModePerm)
+	// Count the references to each stored body and drop the ones left
+	// unreferenced by a previous run
+	blobs := newBlobStore(filepath.Join(cacheDir, "blobs"))
+	blobs.loadRefs(cacheDir)
+	blobs.collectGarbage()
+	stats := newCacheStats()
+	stats.loadRecords(cacheDir)
 	// Return a pointer to the new HTTPCache
 	return &HTTPCache{
 		cacheDir:    cacheDir,
+		blobs:       blobs,
+		stats:       stats,
 		lruQueue:    list.New(),
 		currentSize: 0,
 		maxCap:      200,
@@ -93,38 +121,67 @@ func (e CacheEntry) Bytes() []byte {
 	return buffer.Bytes()
 }
 
-// CacheEntryFromBytes decodes CacheEntry object from its binary representation
-// stored a cache
-func CacheEntryFromBytes(data []byte) *CacheEntry {
+// decodeCacheEntry decodes CacheEntry object from its binary representation
+// stored in a cache. A record that does not decode is reported as an error
+func decodeCacheEntry(data []byte) (*CacheEntry, error) {
 	var entry CacheEntry
 	buffer := bytes.NewBuffer(data)
 	decoder := gob.NewDecoder(buffer)
 	// Decodes the CacheEntry back from the cached file to be sent to client
-	err := decoder.Decode(&entry)
+	if err := decoder.Decode(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// readEntry loads the metadata record stored under key without its body
+func (c *HTTPCache) readEntry(key string) (*CacheEntry, error) {
+	data, err := os.ReadFile(filepath.Join(c.cacheDir, key))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return &entry
+	return decodeCacheEntry(data)
 }
 
 // Put stores a http response in the HTTP cache. It takes an http.Request and http.Response,
 // along with maxAge and lastModified values, and saves the response data to a cache file
 // The response body is also returned as a bytes.Buffer so it can be sent to the client
 func (c *HTTPCache) Put(req *http.Request, resp *http.Response, maxAge int64, lastModified string) (bod bytes.Buffer) {
+	return c.PutAt(req, resp, maxAge, lastModified, time.Now())
+}
+
+// PutAt stores a http response like Put, but records created as the time the
+// response was received, so freshness carries over when importing archives
+func (c *HTTPCache) PutAt(req *http.Request, resp *http.Response, maxAge int64, lastModified string, created time.Time) (bod bytes.Buffer) {
+	bod, _ = c.storeAt(req, resp, maxAge, lastModified, created)
+	return bod
+}
+
+// storeAt does the work of PutAt and also returns why the response could
+// not be stored, for callers that report it. The body is returned either way
+func (c *HTTPCache) storeAt(req *http.Request, resp *http.Response, maxAge int64, lastModified string, created time.Time) (bytes.Buffer, error) {
+	c.mu.Lock()
+	// Stale entries stay cached until replaced, so a key may already be
+	// in the queue; take it out so it is counted only once
+	if elem, ok := c.cacheData[c.CacheKey(req)]; ok {
+		c.lruQueue.Remove(elem)
+		c.currentSize = c.currentSize - 1
+	}
 	c.currentSize = c.currentSize + 1
 	log.Println("Current size after putting one", c.currentSize)
-	change := 0
 	// Evict items if adding the new pair would exceed the limit
-	for (c.currentSize - change) > c.maxCap {
+	for c.currentSize > c.maxCap && c.lruQueue.Len() > 0 {
 		oldestElement := c.lruQueue.Back() // Get the least recently used key
 		stringkey := oldestElement.Value.(string)
-		change = change + 1
 		log.Println("MaxCap Reached...removing")
-		c.RemoveCache(stringkey)
-
+		if entry, err := c.readEntry(stringkey); err == nil {
+			c.stats.recordEviction(hostOf(entry.URL))
+		}
+		c.removeCache(stringkey)
 	}
+	c.mu.Unlock()
+
 	key := c.CacheKey(req)
-	filePath := filepath.Join(c.cacheDir, key)
 	var bodyBuffer bytes.Buffer
 
 	// Copy the response body into the buffer to prevent reading
@@ -132,39 +189,86 @@ func (c *HTTPCache) Put(req *http.Request, resp *http.Response, maxAge int64, la
 	_, err := io.Copy(&bodyBuffer, resp.Body)
 	if err != nil {
 		log.Printf("Error copying response body: %v", err)
-		return
+		return bytes.Buffer{}, err
 	}
 
 	// Store the copied response body to be returned
 	returnedbody := bodyBuffer
+
+	// Store the body once by its content hash; an identical body cached
+	// under another URL is shared rather than written again
+	hash, err := c.blobs.put(returnedbody.Bytes())
+	if err != nil {
+		log.Printf("Error writing cache blob: %v", err)
+		return returnedbody, err
+	}
 	entry := CacheEntry{
-		Body:         returnedbody.Bytes(),
-		Header:       resp.Header,
-		MaxAge:       maxAge,
-		LastModified: lastModified,
-		CreationTime: time.Now(),
-		StatusCode:   resp.StatusCode,
+		Header:        resp.Header,
+		MaxAge:        maxAge,
+		LastModified:  lastModified,
+		CreationTime:  created,
+		StatusCode:    resp.StatusCode,
+		BodyHash:      hash,
+		BodySize:      int64(returnedbody.Len()),
+		URL:           req.URL.String(),
+		RequestHeader: req.Header.Clone(),
 	}
 
+	// Reading the old record, writing the new one and moving the body
+	// reference happen together, so two Puts for the same key cannot both
+	// release the old body and leave a blob another URL uses unreferenced
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old, oldErr := c.readEntry(key)
+
 	// Convert the cache entry into binary format
 	serializedData := entry.Bytes()
-	err = os.WriteFile(filePath, serializedData, 0666)
+	err = c.writeRecord(key, serializedData)
 	if err != nil {
 		log.Printf("Error writing cache file: %v", err)
+		c.blobs.release(hash)
+		c.currentSize = c.currentSize - 1
+		return returnedbody, err
+	}
+
+	c.stats.recordStored(key, req.URL.Hostname(), int64(len(serializedData)))
+
+	// Drop the reference held by the record this one replaced
+	if oldErr == nil {
+		c.stats.recordReplacement(req.URL.Hostname())
+		if old.BodyHash != "" {
+			c.blobs.release(old.BodyHash)
+		}
 	}
 	//c.currentSize = m - change
 	// Update the order of elements in lruQueue by adding the key to the back
 	c.cacheData[key] = c.lruQueue.PushFront(key)
 	log.Println("Current size after removing if needed", c.currentSize)
-	return returnedbody
+	return returnedbody, nil
 }
 
 // Get retrieves a cached HTTP response for a given request
 // It returns the cached http.Response if available and a boolean indicating
 // whether the cache hit was successful
 func (c *HTTPCache) Get(req *http.Request) (*http.Response, bool) {
-	key := c.CacheKey(req)
+	response, _, found := c.lookup(req, false)
+	return response, found
+}
 
+// GetStale retrieves a cached HTTP response for a given request regardless
+// of its freshness, for use when the origin cannot be reached
+// It also reports whether the returned response is stale
+func (c *HTTPCache) GetStale(req *http.Request) (*http.Response, bool, bool) {
+	return c.lookup(req, true)
+}
+
+// lookup loads the cached response for req. Stale entries are only returned
+// when allowStale is set; otherwise they count as a miss but stay on disk,
+// so they can still be served in offline mode until a fresh response
+// replaces them
+func (c *HTTPCache) lookup(req *http.Request, allowStale bool) (*http.Response, bool, bool) {
+	key := c.CacheKey(req)
 	filePath := filepath.Join(c.cacheDir, key)
 
 	// Attempt to read the cached data from the file system
@@ -173,30 +277,51 @@ func (c *HTTPCache) Get(req *http.Request) (*http.Response, bool) {
 		// If the file doesn't exist, it means the response is not cached,
 		// return nil and false
 		if os.IsNotExist(err) {
-			return nil, false
+			return nil, false, false
 		}
 		log.Printf("Error reading cache file: %v", err)
-		return nil, false
+		return nil, false, false
 	}
 
-	// Converts the byte data back into a CacheEntry object
-	entry := CacheEntryFromBytes(data)
+	// Converts the byte data back into a CacheEntry object. A record that
+	// does not decode, e.g. one truncated by a crash, is quarantined and
+	// treated as a miss so the response is fetched again
+	entry, err := decodeCacheEntry(data)
+	if err != nil {
+		c.quarantine(key, err)
+		return nil, false, false
+	}
 
-	// Check if the cache entry is stale. If it is, remove it and return no response
-	if (entry).isStale() {
+	// Check if the cache entry is stale. If it is, return no response
+	// unless the caller accepts stale responses
+	stale := entry.isStale()
+	if stale && !allowStale {
 		log.Printf("Cache entry for key: %s is stale.", key)
-		c.RemoveCache(key)
-		return nil, false
+		return nil, true, false
+	}
+
+	// Load the body from the blob store and check it against the checksum
+	// and size recorded with it. Records written before bodies were
+	// deduplicated still carry the body inline
+	body, err := c.loadBody(key, entry)
+	if err != nil {
+		return nil, false, false
 	}
+	entry.Body = body
 
 	response := &http.Response{
-		StatusCode: entry.StatusCode,
-		Body:       io.NopCloser(bytes.NewBuffer(entry.Body)),
-		Header:     entry.Header,
+		StatusCode:    entry.StatusCode,
+		Body:          io.NopCloser(bytes.NewBuffer(entry.Body)),
+		ContentLength: int64(len(entry.Body)),
+		Header:        entry.Header,
+	}
+	c.mu.Lock()
+	if elem, ok := c.cacheData[key]; ok {
+		c.lruQueue.MoveToFront(elem)
 	}
-	c.lruQueue.MoveToFront(c.cacheData[key])
+	c.mu.Unlock()
 
-	return response, true
+	return response, stale, true
 }
 
 // init is a special Go function that gets called automatically when its package is initialized
@@ -210,21 +335,57 @@ func init() {
 
 // RemoveCache deletes a stale cached file associated with a given key
 func (c *HTTPCache) RemoveCache(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeCache(key)
+}
+
+// removeCache does the work of RemoveCache. The caller must hold c.mu
+func (c *HTTPCache) removeCache(key string) {
 	filePath := filepath.Join(c.cacheDir, key)
 	// log.Printf("Removing filePath (%s) from Cache...\n", filePath)
-	c.lruQueue.Remove(c.cacheData[key])
-	delete(c.cacheData, key)
-	c.currentSize = c.currentSize - 1
+	c.forgetKey(key)
+
+	// Release the body so it can be garbage collected once no other
+	// record shares it
+	if entry, err := c.readEntry(key); err == nil {
+		if entry.BodyHash != "" {
+			c.blobs.release(entry.BodyHash)
+		}
+	}
 	// Attempt to remove the cache file from the file system
 	err := os.Remove(filePath)
 	if err != nil {
 		log.Printf("Error removing filePath (%s) from Cache: %v\n", filePath, err)
 		return
 	}
+	c.stats.recordRemoved(key)
 
 	log.Printf("FilePath (%s) removed from Cache successfully!\n", filePath)
 }
 
+// forgetKey drops key from the LRU queue and the count of cached entries
+// after its record was moved out of the cache. The caller must hold c.mu
+func (c *HTTPCache) forgetKey(key string) {
+	if elem, ok := c.cacheData[key]; ok {
+		c.lruQueue.Remove(elem)
+		delete(c.cacheData, key)
+		c.currentSize = c.currentSize - 1
+	}
+}
+
+// CollectGarbage deletes stored bodies that no cached URL refers to anymore
+// It returns the number of bodies removed and the bytes freed
+func (c *HTTPCache) CollectGarbage() (int, int64) {
+	return c.blobs.collectGarbage()
+}
+
+// DedupStats reports how many bytes are saved by storing identical
+// response bodies only once
+func (c *HTTPCache) DedupStats() DedupStats {
+	return c.blobs.stats()
+}
+
 // isStale checks if the cache entry is stale based on its MaxAge value
 // It returns true if the cache entry is considered stale, and false otherwise
 func (e CacheEntry) isStale() bool {
@@ -1,3 +1,3 @@
 module cos316.princeton.edu/assignment2
 
-go 1.17
\ No newline at end of file
+go 1.18
\ No newline at end of file
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// newAdminMux builds the handler for the proxy's own endpoints
+// These are reached by requests addressed to the proxy itself rather than
+// to an origin, e.g. "curl http://127.0.0.1:9999/offline", and are only
+// served to clients on the loopback interface
+func newAdminMux(p *forwardProxy) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", p.handleStatus)
+	mux.HandleFunc("/offline", p.handleOffline)
+	mux.HandleFunc("/warm", p.handleWarm)
+	mux.HandleFunc("/export.warc", p.handleExportWARC)
+	mux.HandleFunc("/export.har", p.handleExportHAR)
+	mux.HandleFunc("/peers", p.handlePeers)
+	mux.HandleFunc("/scrub", p.handleScrub)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip := net.ParseIP(extractClientIP(req))
+		if ip == nil || !ip.IsLoopback() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+// proxyStatus is the report served by the /status endpoint
+type proxyStatus struct {
+	Offline bool       `json:"offline"`
+	Cache   CacheStats `json:"cache"`
+	Blocks  BlockStats `json:"blocks"`
+}
+
+// handleStatus reports the proxy's state and cache statistics as JSON,
+// with counters broken down by host, and how often each rule blocked a
+// request
+func (p *forwardProxy) handleStatus(w http.ResponseWriter, req *http.Request) {
+	status := proxyStatus{
+		Offline: p.offline.Offline(),
+		Cache:   p.cache.Stats(),
+		Blocks:  p.audit.Stats(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(status)
+}
+
+// handleOffline reports the offline mode state on GET and switches the
+// manual toggle on POST, e.g. "curl -X POST localhost:9999/offline?enable=true"
+func (p *forwardProxy) handleOffline(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "POST":
+		enable, err := strconv.ParseBool(req.URL.Query().Get("enable"))
+		if err != nil {
+			http.Error(w, "enable must be true or false", http.StatusBadRequest)
+			return
+		}
+		p.offline.SetManual(enable)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "offline: %v\n", p.offline.Offline())
+}
+
+// handleWarm warms the cache on POST. The URLs come from a list file or
+// sitemap named by the src parameter (a local path or an http URL), or from
+// the request body, e.g. "curl --data-binary @urls.txt localhost:9999/warm"
+// The optional concurrency and rate parameters bound the fetches, and the
+// report is returned as JSON
+func (p *forwardProxy) handleWarm(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query()
+	var data []byte
+	var err error
+	if src := query.Get("src"); src != "" {
+		data, err = p.readWarmSource(src)
+	} else {
+		data, err = io.ReadAll(req.Body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	urls, err := p.parseWarmURLs(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	concurrency := 4
+	if v := query.Get("concurrency"); v != "" {
+		if concurrency, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "concurrency must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	rate := 10.0
+	if v := query.Get("rate"); v != "" {
+		if rate, err = strconv.ParseFloat(v, 64); err != nil {
+			http.Error(w, "rate must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	report := p.warmCache(urls, concurrency, rate)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleExportWARC downloads the whole cache as a WARC file
+func (p *forwardProxy) handleExportWARC(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/warc")
+	w.Header().Set("Content-Disposition", `attachment; filename="http_cache.warc"`)
+	if err := p.cache.ExportWARC(w); err != nil {
+		log.Println("Exporting WARC:", err)
+	}
+}
+
+// handleExportHAR downloads a browsing session from the cache as a HAR file
+// The optional since (RFC 3339 time) and host parameters select the session
+func (p *forwardProxy) handleExportHAR(w http.ResponseWriter, req *http.Request) {
+	var since time.Time
+	if v := req.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="session.har"`)
+	if err := p.cache.ExportHAR(w, since, req.URL.Query().Get("host")); err != nil {
+		log.Println("Exporting HAR:", err)
+	}
+}
+
+// handlePeers reports the health of the sibling proxies as JSON
+func (p *forwardProxy) handlePeers(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.peers.Status())
+}
+
+// handleScrub checks the whole cache for corrupt entries right away and
+// reports what was found as JSON
+func (p *forwardProxy) handleScrub(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.cache.Scrub())
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// forEachEntry calls fn with every cached entry, body included, in order of
+// creation. Entries written before the URL was recorded are skipped since
+// they cannot be exported, and so are entries whose body fails its checksum,
+// which are quarantined as on a cache lookup
+func (c *HTTPCache) forEachEntry(fn func(entry *CacheEntry)) error {
+	files, err := os.ReadDir(c.cacheDir)
+	if err != nil {
+		return err
+	}
+
+	type keyedEntry struct {
+		key   string
+		entry *CacheEntry
+	}
+	var entries []keyedEntry
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		entry, err := c.readEntry(f.Name())
+		if err != nil {
+			log.Printf("Skipping cache file (%s): %v\n", f.Name(), err)
+			continue
+		}
+		if entry.URL == "" {
+			continue
+		}
+		entries = append(entries, keyedEntry{f.Name(), entry})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].entry.CreationTime.Before(entries[j].entry.CreationTime)
+	})
+
+	for _, e := range entries {
+		body, err := c.loadBody(e.key, e.entry)
+		if err != nil {
+			log.Printf("Skipping %s: %v\n", e.entry.URL, err)
+			continue
+		}
+		e.entry.Body = body
+		fn(e.entry)
+	}
+	return nil
+}
+
+// runArchiveCommand carries out the -export-warc, -import-warc and
+// -export-har command line options; empty file names are skipped
+func runArchiveCommand(cache *HTTPCache, exportWARC, importWARC, exportHAR, harSince, harHost string) error {
+	if importWARC != "" {
+		f, err := os.Open(importWARC)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := cache.ImportWARC(f); err != nil {
+			return err
+		}
+	}
+
+	if exportWARC != "" {
+		f, err := os.Create(exportWARC)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var w io.Writer = f
+		if strings.HasSuffix(exportWARC, ".gz") {
+			zw := gzip.NewWriter(f)
+			defer zw.Close()
+			w = zw
+		}
+		if err := cache.ExportWARC(w); err != nil {
+			return err
+		}
+	}
+
+	if exportHAR != "" {
+		var since time.Time
+		if harSince != "" {
+			var err error
+			if since, err = time.Parse(time.RFC3339, harSince); err != nil {
+				return err
+			}
+		}
+		f, err := os.Create(exportHAR)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := cache.ExportHAR(f, since, harHost); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------
+// WARC
+
+// warcRecord is a single record of a WARC file: its named fields and block
+type warcRecord struct {
+	header textproto.MIMEHeader
+	block  []byte
+}
+
+// newWARCRecordID returns a fresh WARC-Record-ID, a random UUID URN
+func newWARCRecordID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // Version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// writeWARCRecord writes one WARC/1.1 record with the given fields and block
+func writeWARCRecord(w io.Writer, fields [][2]string, block []byte) error {
+	var head bytes.Buffer
+	head.WriteString("WARC/1.1\r\n")
+	for _, f := range fields {
+		fmt.Fprintf(&head, "%s: %s\r\n", f[0], f[1])
+	}
+	fmt.Fprintf(&head, "Content-Length: %d\r\n\r\n", len(block))
+	if _, err := w.Write(head.Bytes()); err != nil {
+		return err
+	}
+	if _, err := w.Write(block); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n\r\n")
+	return err
+}
+
+// maxWARCRecordSize bounds the records read from a WARC file, which may
+// come from anywhere and claim any length
+const maxWARCRecordSize = 256 << 20
+
+// credentialHeaders are request and response headers that carry the
+// client's credentials or session cookies and are left out of exported
+// archives
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "Set-Cookie2"}
+
+// exportedHeader returns a copy of the request or response headers of a
+// cached entry to put in an archive, without the client's credentials
+func exportedHeader(h http.Header) http.Header {
+	header := h.Clone()
+	for _, name := range credentialHeaders {
+		header.Del(name)
+	}
+	return header
+}
+
+// httpRequestBlock renders the request line and headers of a cached entry
+// as an application/http request message
+func httpRequestBlock(entry *CacheEntry) []byte {
+	req, err := http.NewRequest("GET", entry.URL, nil)
+	if err != nil {
+		return nil
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "GET %s HTTP/1.1\r\nHost: %s\r\n", req.URL.RequestURI(), req.URL.Host)
+	exportedHeader(entry.RequestHeader).Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// httpResponseBlock renders a cached entry as an application/http response
+// message. The body is stored as it was received, with any Content-Encoding
+// kept, but without chunked framing, so only the framing headers are
+// rewritten to match it
+func httpResponseBlock(entry *CacheEntry) []byte {
+	header := exportedHeader(entry.Header)
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(entry.Body)))
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", entry.StatusCode, http.StatusText(entry.StatusCode))
+	header.Write(&b)
+	b.WriteString("\r\n")
+	b.Write(entry.Body)
+	return b.Bytes()
+}
+
+// ExportWARC writes every cached entry to w as a WARC/1.1 file. Each entry
+// becomes a request and a response record, followed by a metadata record
+// carrying the proxy's freshness information (max-age and Last-Modified)
+func (c *HTTPCache) ExportWARC(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	info := []byte("software: forward-proxy\r\nformat: WARC File Format 1.1\r\n")
+	err := writeWARCRecord(bw, [][2]string{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", newWARCRecordID()},
+		{"WARC-Date", now},
+		{"Content-Type", "application/warc-fields"},
+	}, info)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	var writeErr error
+	err = c.forEachEntry(func(entry *CacheEntry) {
+		if writeErr != nil {
+			return
+		}
+		date := entry.CreationTime.UTC().Format(time.RFC3339Nano)
+		requestID, responseID := newWARCRecordID(), newWARCRecordID()
+
+		writeErr = writeWARCRecord(bw, [][2]string{
+			{"WARC-Type", "response"},
+			{"WARC-Record-ID", responseID},
+			{"WARC-Date", date},
+			{"WARC-Target-URI", entry.URL},
+			{"WARC-Payload-Digest", "sha256:" + blobHash(entry.Body)},
+			{"Content-Type", "application/http;msgtype=response"},
+		}, httpResponseBlock(entry))
+		if writeErr != nil {
+			return
+		}
+		writeErr = writeWARCRecord(bw, [][2]string{
+			{"WARC-Type", "request"},
+			{"WARC-Record-ID", requestID},
+			{"WARC-Date", date},
+			{"WARC-Target-URI", entry.URL},
+			{"WARC-Concurrent-To", responseID},
+			{"Content-Type", "application/http;msgtype=request"},
+		}, httpRequestBlock(entry))
+		if writeErr != nil {
+			return
+		}
+		freshness := fmt.Sprintf("max-age: %d\r\nlast-modified: %s\r\n", entry.MaxAge, entry.LastModified)
+		writeErr = writeWARCRecord(bw, [][2]string{
+			{"WARC-Type", "metadata"},
+			{"WARC-Record-ID", newWARCRecordID()},
+			{"WARC-Date", date},
+			{"WARC-Target-URI", entry.URL},
+			{"WARC-Refers-To", responseID},
+			{"Content-Type", "application/warc-fields"},
+		}, []byte(freshness))
+		if writeErr == nil {
+			count++
+		}
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Exported %d cache entries to WARC\n", count)
+	return bw.Flush()
+}
+
+// readWARCRecord reads the next record from r, returning io.EOF when there
+// are no more records
+func readWARCRecord(r *bufio.Reader) (*warcRecord, error) {
+	tp := textproto.NewReader(r)
+	// Skip the blank lines that separate records
+	var version string
+	for version == "" {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		version = strings.TrimSpace(line)
+	}
+	if !strings.HasPrefix(version, "WARC/") {
+		return nil, fmt.Errorf("invalid WARC record: %q", version)
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WARC Content-Length: %v", err)
+	}
+	if length < 0 || length > maxWARCRecordSize {
+		return nil, fmt.Errorf("invalid WARC Content-Length %d, must be between 0 and %d", length, maxWARCRecordSize)
+	}
+	// Read what is there rather than allocating what the header claims, so
+	// a truncated file fails without a large allocation
+	var block bytes.Buffer
+	if n, err := io.CopyN(&block, r, length); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("WARC record ends after %d of %d bytes", n, length)
+		}
+		return nil, err
+	}
+	return &warcRecord{header: header, block: block.Bytes()}, nil
+}
+
+// parseWARCFields parses an application/warc-fields block
+func parseWARCFields(block []byte) textproto.MIMEHeader {
+	tp := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(block), strings.NewReader("\r\n"))))
+	fields, _ := tp.ReadMIMEHeader()
+	return fields
+}
+
+// ImportWARC populates the cache with the GET responses found in a WARC file
+// read from r (plain or gzipped). Request headers come from the matching
+// request record. Freshness comes from the proxy's own metadata records when
+// present, and otherwise from the response's Cache-Control header, with the
+// WARC-Date as the time the response was received
+// It returns the number of entries imported
+func (c *HTTPCache) ImportWARC(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+
+	// Related records may come in any order, so collect them all first
+	var responses []*warcRecord
+	requests := make(map[string]*warcRecord)
+	metadata := make(map[string]textproto.MIMEHeader)
+	for {
+		rec, err := readWARCRecord(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch rec.header.Get("WARC-Type") {
+		case "response":
+			responses = append(responses, rec)
+		case "request":
+			if id := rec.header.Get("WARC-Concurrent-To"); id != "" {
+				requests[id] = rec
+			}
+		case "metadata":
+			if id := rec.header.Get("WARC-Refers-To"); id != "" {
+				metadata[id] = parseWARCFields(rec.block)
+			}
+		}
+	}
+
+	imported := 0
+	for _, rec := range responses {
+		target := rec.header.Get("WARC-Target-URI")
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil || req.URL.Scheme != "http" {
+			continue
+		}
+		id := rec.header.Get("WARC-Record-ID")
+		if reqRec, ok := requests[id]; ok {
+			parsed, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(reqRec.block)))
+			if err != nil || parsed.Method != "GET" {
+				continue
+			}
+			req.Header = parsed.Header
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(rec.block)), req)
+		if err != nil {
+			log.Printf("Skipping %s: %v\n", target, err)
+			continue
+		}
+
+		created, err := time.Parse(time.RFC3339, rec.header.Get("WARC-Date"))
+		if err != nil {
+			created = time.Now()
+		}
+		maxAge, lastModified := int64(-1), resp.Header.Get("Last-Modified")
+		if fields, ok := metadata[id]; ok {
+			if v, err := strconv.ParseInt(fields.Get("max-age"), 10, 64); err == nil {
+				maxAge = v
+			}
+			lastModified = fields.Get("last-modified")
+		} else if age, ok := parseMaxAge(resp.Header.Get("Cache-Control")); ok {
+			maxAge = age
+		}
+		if lastModified == "" {
+			lastModified = "na"
+		}
+
+		_, err = c.storeAt(req, resp, maxAge, lastModified, created)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("Skipping %s: %v\n", target, err)
+			continue
+		}
+		imported++
+	}
+	log.Printf("Imported %d cache entries from WARC\n", imported)
+	return imported, nil
+}
+
+// --------------------------------------------------------------------
+// HAR
+
+// The following types cover the subset of HAR 1.2 the proxy can fill in
+// from its cache. Timings are unknown for cached responses and left at 0
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harHeaders flattens an http.Header into HAR name/value pairs
+func harHeaders(h http.Header) []harNameValue {
+	pairs := []harNameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			pairs = append(pairs, harNameValue{Name: name, Value: v})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Name < pairs[j].Name })
+	return pairs
+}
+
+// isTextContent reports whether a body of this Content-Type can be put in a
+// HAR file as text rather than base64
+func isTextContent(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") || strings.Contains(contentType, "json") ||
+		strings.Contains(contentType, "xml") || strings.Contains(contentType, "javascript")
+}
+
+// ExportHAR writes the cached entries of a single browsing session to w as a
+// HAR 1.2 file: those created at or after since and, if host is not empty,
+// requested from that host
+func (c *HTTPCache) ExportHAR(w io.Writer, since time.Time, host string) error {
+	var har harLog
+	har.Log.Version = "1.2"
+	har.Log.Creator = harCreator{Name: "forward-proxy", Version: "1.0"}
+	har.Log.Entries = []harEntry{}
+
+	err := c.forEachEntry(func(entry *CacheEntry) {
+		if entry.CreationTime.Before(since) {
+			return
+		}
+		req, err := http.NewRequest("GET", entry.URL, nil)
+		if err != nil || (host != "" && req.URL.Hostname() != host) {
+			return
+		}
+
+		query := []harNameValue{}
+		for name, values := range req.URL.Query() {
+			for _, v := range values {
+				query = append(query, harNameValue{Name: name, Value: v})
+			}
+		}
+		mimeType := entry.Header.Get("Content-Type")
+		content := harContent{Size: len(entry.Body), MimeType: mimeType}
+		if isTextContent(mimeType) {
+			content.Text = string(entry.Body)
+		} else if len(entry.Body) > 0 {
+			content.Text = base64.StdEncoding.EncodeToString(entry.Body)
+			content.Encoding = "base64"
+		}
+
+		har.Log.Entries = append(har.Log.Entries, harEntry{
+			StartedDateTime: entry.CreationTime.Format(time.RFC3339Nano),
+			Request: harRequest{
+				Method:      "GET",
+				URL:         entry.URL,
+				HTTPVersion: "HTTP/1.1",
+				Cookies:     []harNameValue{},
+				Headers:     harHeaders(exportedHeader(entry.RequestHeader)),
+				QueryString: query,
+				HeadersSize: -1,
+				BodySize:    0,
+			},
+			Response: harResponse{
+				Status:      entry.StatusCode,
+				StatusText:  http.StatusText(entry.StatusCode),
+				HTTPVersion: "HTTP/1.1",
+				Cookies:     []harNameValue{},
+				Headers:     harHeaders(exportedHeader(entry.Header)),
+				Content:     content,
+				RedirectURL: entry.Header.Get("Location"),
+				HeadersSize: -1,
+				BodySize:    len(entry.Body),
+			},
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(har)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// auditRecord is one blocked request, written to the audit log as a line
+// of JSON
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"` // As shown on the block page
+	ClientIP  string    `json:"client_ip"`
+	User      string    `json:"user,omitempty"` // Proxy user, when authentication is enabled
+	Group     string    `json:"group"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	URL       string    `json:"url"`
+	Rule      string    `json:"rule,omitempty"` // Empty under default-deny and for invalid tunnels
+	List      string    `json:"list,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	Reason    string    `json:"reason"`
+}
+
+// RuleHits counts the requests one rule blocked
+type RuleHits struct {
+	Rule    string    `json:"rule"`
+	List    string    `json:"list"`
+	Source  string    `json:"source"`
+	Hits    int64     `json:"hits"`
+	LastHit time.Time `json:"last_hit"`
+}
+
+// BlockStats is a snapshot of the block counters, served by /status
+type BlockStats struct {
+	Total int64       `json:"total"`
+	Rules []*RuleHits `json:"rules"` // Most hits first
+}
+
+// auditLog records every blocked request to a file that is rotated when it
+// grows too large, and counts the blocks per rule. The counters are kept
+// even when no file is written
+type auditLog struct {
+	mu       sync.Mutex
+	path     string // Empty when no audit file is written
+	maxSize  int64  // Size at which the file is rotated
+	maxFiles int    // Rotated files kept, as path.1 (newest) to path.N
+	file     *os.File
+	size     int64
+
+	total int64
+	rules map[string]*RuleHits // Keyed by the rule's source, or its reason
+}
+
+// newAuditLog opens the audit file at path for appending, unless path is
+// empty. Once it reaches maxSize bytes it is renamed to path.1, older
+// files move up by one and the oldest beyond maxFiles is deleted
+func newAuditLog(path string, maxSize int64, maxFiles int) (*auditLog, error) {
+	a := &auditLog{path: path, maxSize: maxSize, maxFiles: maxFiles, rules: make(map[string]*RuleHits)}
+	if path == "" {
+		return a, nil
+	}
+	if maxSize <= 0 || maxFiles < 0 {
+		return nil, fmt.Errorf("audit log size must be positive and rotated files at least 0")
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// open opens the audit file and notes its current size
+func (a *auditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file, a.size = file, info.Size()
+	return nil
+}
+
+// rotate moves the full audit file aside and starts a new one
+func (a *auditLog) rotate() error {
+	a.file.Close()
+	a.file = nil
+	if a.maxFiles == 0 {
+		os.Remove(a.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", a.path, a.maxFiles))
+		for i := a.maxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+		}
+		if err := os.Rename(a.path, a.path+".1"); err != nil {
+			return err
+		}
+	}
+	return a.open()
+}
+
+// record counts a blocked request and appends it to the audit file
+// rule is nil when the request was not blocked by a rule, in which case
+// reason says why it was
+func (a *auditLog) record(req *http.Request, rule *blockRule, user, groupName, requestID, reason string) {
+	r := auditRecord{
+		Time:      time.Now(),
+		RequestID: requestID,
+		ClientIP:  extractClientIP(req),
+		User:      user,
+		Group:     groupName,
+		Method:    req.Method,
+		Host:      req.URL.Hostname(),
+		URL:       req.URL.String(),
+		Reason:    reason,
+	}
+	if req.Method == "CONNECT" {
+		r.URL = req.URL.Host
+	}
+	key := reason
+	if rule != nil {
+		r.Rule, r.List, r.Source = rule.text, rule.list, rule.source
+		key = rule.source
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.total++
+	hits, ok := a.rules[key]
+	if !ok {
+		hits = &RuleHits{Rule: r.Rule, List: r.List, Source: r.Source}
+		if rule == nil {
+			hits.Rule = reason
+		}
+		a.rules[key] = hits
+	}
+	hits.Hits++
+	hits.LastHit = r.Time
+
+	if a.path == "" {
+		return
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Error encoding audit record: %v\n", err)
+		return
+	}
+	line = append(line, '\n')
+	if a.file != nil && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			log.Printf("Error rotating audit log: %v\n", err)
+		}
+	}
+	if a.file == nil {
+		// A failed rotation is retried with the next record
+		if err := a.open(); err != nil {
+			log.Printf("Error opening audit log: %v\n", err)
+			return
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("Error writing audit log: %v\n", err)
+	}
+}
+
+// Stats returns the block counters, the rules with the most hits first
+func (a *auditLog) Stats() BlockStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats := BlockStats{Total: a.total, Rules: make([]*RuleHits, 0, len(a.rules))}
+	for _, hits := range a.rules {
+		copied := *hits
+		stats.Rules = append(stats.Rules, &copied)
+	}
+	sort.Slice(stats.Rules, func(i, j int) bool {
+		if stats.Rules[i].Hits != stats.Rules[j].Hits {
+			return stats.Rules[i].Hits > stats.Rules[j].Hits
+		}
+		return stats.Rules[i].Source < stats.Rules[j].Source
+	})
+	return stats
+}
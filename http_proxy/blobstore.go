@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// blobStore keeps response bodies on disk once per distinct content
+// Each body is written to a file named after the SHA-256 of its bytes, so
+// byte-identical responses for different URLs (CDN mirrors, cache-busting
+// query strings) share a single copy. The per-URL metadata records refer to
+// a blob by its hash, and refs counts how many records point at each blob
+type blobStore struct {
+	dir   string
+	mu    sync.Mutex
+	refs  map[string]int   // Number of metadata records referring to each blob
+	sizes map[string]int64 // Size in bytes of each blob on disk
+}
+
+// DedupStats summarizes how much space the content-addressed store is saving
+type DedupStats struct {
+	Blobs        int   `json:"blobs"`         // Number of distinct bodies stored
+	References   int   `json:"references"`    // Number of metadata records referring to a blob
+	StoredBytes  int64 `json:"stored_bytes"`  // Bytes actually kept on disk for bodies
+	LogicalBytes int64 `json:"logical_bytes"` // Bytes that would be kept with one copy per record
+	SavedBytes   int64 `json:"saved_bytes"`   // LogicalBytes - StoredBytes
+}
+
+// newBlobStore creates a blobStore rooted at dir, creating the directory
+// if it does not exist yet
+func newBlobStore(dir string) *blobStore {
+	os.MkdirAll(dir, os.ModePerm)
+	return &blobStore{
+		dir:   dir,
+		refs:  make(map[string]int),
+		sizes: make(map[string]int64),
+	}
+}
+
+// blobHash returns the hex-encoded SHA-256 of a body, which is also the
+// name of the file the body is stored in
+func blobHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// path returns the location of the blob with the given hash
+func (b *blobStore) path(hash string) string {
+	return filepath.Join(b.dir, hash)
+}
+
+// put stores body if no identical body is stored yet, adds one reference
+// to it and returns its hash
+func (b *blobStore) put(body []byte) (string, error) {
+	hash := blobHash(body)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := os.Stat(b.path(hash)); os.IsNotExist(err) {
+		// Write to a temporary file first so a crash never leaves a
+		// partially written blob under its final name
+		tmp, err := os.CreateTemp(b.dir, "tmp-")
+		if err != nil {
+			return "", err
+		}
+		_, err = tmp.Write(body)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), b.path(hash))
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return "", err
+		}
+	}
+
+	b.refs[hash]++
+	b.sizes[hash] = int64(len(body))
+	return hash, nil
+}
+
+// get reads the body stored under hash
+func (b *blobStore) get(hash string) ([]byte, error) {
+	return os.ReadFile(b.path(hash))
+}
+
+// release drops one reference to the blob with the given hash. Blobs left
+// without references are removed by the next collectGarbage call
+func (b *blobStore) release(hash string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.refs[hash] > 0 {
+		b.refs[hash]--
+	}
+}
+
+// loadRefs rebuilds the reference counts from the metadata records stored
+// in cacheDir. It is called once at startup, before the cache is in use
+func (b *blobStore) loadRefs(cacheDir string) {
+	files, err := os.ReadDir(cacheDir)
+	if err != nil {
+		log.Printf("Error reading cache directory: %v", err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(cacheDir, f.Name()))
+		if err != nil {
+			continue
+		}
+		entry, err := decodeCacheEntry(data)
+		if err != nil || entry.BodyHash == "" {
+			continue
+		}
+		b.refs[entry.BodyHash]++
+		b.sizes[entry.BodyHash] = entry.BodySize
+	}
+}
+
+// collectGarbage removes every blob on disk that no metadata record refers
+// to, along with temporary files left behind by interrupted writes
+// It holds the lock for the whole pass, so a concurrent put can never have
+// its blob deleted between writing it and recording the reference
+// It returns the number of blobs removed and the bytes freed
+func (b *blobStore) collectGarbage() (removed int, freed int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	files, err := os.ReadDir(b.dir)
+	if err != nil {
+		log.Printf("Error reading blob directory: %v", err)
+		return 0, 0
+	}
+
+	for _, f := range files {
+		hash := f.Name()
+		if b.refs[hash] > 0 {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(b.path(hash)); err != nil {
+			log.Printf("Error removing blob (%s): %v\n", hash, err)
+			continue
+		}
+		delete(b.refs, hash)
+		delete(b.sizes, hash)
+		removed++
+		freed += info.Size()
+	}
+	return removed, freed
+}
+
+// stats reports the number of blobs and references and the bytes saved by
+// storing each distinct body once
+func (b *blobStore) stats() DedupStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var s DedupStats
+	for hash, n := range b.refs {
+		if n == 0 {
+			continue
+		}
+		size := b.sizes[hash]
+		s.Blobs++
+		s.References += n
+		s.StoredBytes += size
+		s.LogicalBytes += size * int64(n)
+	}
+	s.SavedBytes = s.LogicalBytes - s.StoredBytes
+	return s
+}
@@ -2,48 +2,500 @@ package main
 
 import (
 	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
 	"os"
 	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // BlockedSet represents a structure for storing a set of blocked domain patterns
-// It contains a slice (a dynamically-sized, flexible list) of pointers to regexp
-// Each slice stores the compiled regular expressions for the domain patterns that we want to block
-// Our blocked sites is written in blocked-domains.txt
+// Our blocked sites is written in blocked-domains.txt, one rule per line, and
+// more lists in other formats can be loaded alongside it (see blocklists.go)
+// Rules starting with "@@" allow a host instead and take precedence over
+// block rules in every list. Hosts no rule matches are allowed, or blocked
+// when the set is in default-deny mode
+// The lists are reloaded when a file changes or on Reload, and swapped in
+// atomically, so concurrent IsBlocked calls always see complete lists
 type BlockedSet struct {
-	blockedDomains []*regexp.Regexp
+	lists       []*blockList
+	rules       atomic.Value     // []*blockedRules, one per list
+	defaultDeny atomic.Value     // bool
+	clock       func() time.Time // Time rule schedules are evaluated at; replaceable in tests
+
+	mu sync.Mutex // Serializes reloads
 }
 
-// NewBlockedSet populates an array with sites it reads from a given file and
+// NewBlockedSet populates the rules it reads from the given list files and
 // returns a pointer to a BlockedSet and any error encountered during the process
-func NewBlockedSet(filename string) (*BlockedSet, error) {
-	file, err := os.Open(filename)
-	if err != nil {
+// Each list is given as [name=][format:]path, see parseBlockList
+func NewBlockedSet(lists ...string) (*BlockedSet, error) {
+	bs := &BlockedSet{clock: time.Now}
+	bs.defaultDeny.Store(false)
+	for _, spec := range lists {
+		list, err := parseBlockList(spec)
+		if err != nil {
+			return nil, err
+		}
+		bs.lists = append(bs.lists, list)
+
+		// Lists published on a server are fetched before the first load,
+		// which falls back to the copy of the last run if that fails
+		if list.url != "" {
+			if _, err := list.fetch(); err != nil {
+				if _, statErr := os.Stat(list.filename); statErr != nil {
+					return nil, fmt.Errorf("block list %s: %v, and no copy from an earlier fetch", list.name, err)
+				}
+				log.Printf("Error fetching block list %s, using the copy from an earlier fetch: %v\n", list.name, err)
+			}
+		}
+	}
+	if err := bs.Reload(); err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	return bs, nil
+}
 
-	var domains []*regexp.Regexp
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		domain, err := regexp.Compile(scanner.Text())
-		if err != nil {
-			return nil, err
+// blockRule is one rule of a list, kept so decisions can be explained
+type blockRule struct {
+	text     string         // The rule as written in the file
+	list     string         // Name of the list the rule belongs to
+	source   string         // File and line the rule was read from, e.g. "blocked-domains.txt:12"
+	allow    bool           // The rule allows matching hosts rather than blocking them
+	schedule *schedule      // When the rule applies; nil means always
+	filter   *requestFilter // Requests the rule applies to; nil means all
+}
+
+// ruleQuery is what rules are matched against
+type ruleQuery struct {
+	host string        // Lower-case host name, without a trailing dot
+	now  time.Time     // Time schedules are evaluated at
+	req  *http.Request // The request, or nil when only the host is known
+}
+
+// applies reports whether the rule's schedule and request filter let it
+// apply to q. The host is matched separately
+func (r *blockRule) applies(q *ruleQuery) bool {
+	return r.schedule.active(q.now) && r.filter.matches(q.req)
+}
+
+func (r *blockRule) String() string {
+	return fmt.Sprintf("%q (list %s, %s)", r.text, r.list, r.source)
+}
+
+// blockedRules is one loaded version of a list
+// Patterns that only name a domain, its subdomains or both go into a suffix
+// trie, so looking up a host costs one step per label however long the list
+// is. Only patterns that need a real regular expression are kept as regexps
+// and run against every host. Allow and block rules are kept apart so an
+// allow rule wins regardless of the order of the file
+type blockedRules struct {
+	name  string
+	allow *ruleIndex
+	block *ruleIndex
+	count int // Number of rules loaded
+}
+
+func newBlockedRules(name string) *blockedRules {
+	return &blockedRules{name: name, allow: newRuleIndex(), block: newRuleIndex()}
+}
+
+// ruleIndex holds the allow or the block rules of a list
+type ruleIndex struct {
+	domains  *domainTrie
+	patterns []patternRule
+	nets     []netRule // Address and range rules, see ipfilter.go
+}
+
+// patternRule is a rule that needs a regular expression
+type patternRule struct {
+	re   *regexp.Regexp
+	rule *blockRule
+}
+
+func newRuleIndex() *ruleIndex {
+	return &ruleIndex{domains: newDomainTrie()}
+}
+
+// match returns the first rule of the index matching q, or nil
+func (ri *ruleIndex) match(q *ruleQuery) *blockRule {
+	if rule := ri.domains.match(q); rule != nil {
+		return rule
+	}
+	if ip := net.ParseIP(q.host); ip != nil {
+		if rule := ri.matchIP(ip, q); rule != nil {
+			return rule
 		}
-		domains = append(domains, domain)
 	}
+	for _, p := range ri.patterns {
+		if p.rule.applies(q) && p.re.MatchString(q.host) {
+			return p.rule
+		}
+	}
+	return nil
+}
 
-	return &BlockedSet{blockedDomains: domains}, scanner.Err()
+// domainTrie is a suffix trie over the labels of domain names, starting
+// from the top-level label, e.g. "com" -> "example" -> "www"
+type domainTrie struct {
+	children   map[string]*domainTrie
+	exact      []*blockRule // Rules matching the domain ending at this node
+	subdomains []*blockRule // Rules matching every subdomain of that domain
 }
 
-// IsBlocked checks if the given domain is in the blocked domains array
-// It returns true if the domain matches any of the regular expressions 
-// in the BlockedSet, indicating that the domain is blocked
-func (bs *BlockedSet) IsBlocked(domain string) bool {
-	for _, d := range bs.blockedDomains {
-		if d.MatchString(domain) {
+func newDomainTrie() *domainTrie {
+	return &domainTrie{children: make(map[string]*domainTrie)}
+}
+
+// insert adds domain to the trie, matching the domain itself when exact is
+// set and its subdomains when subdomains is set
+func (t *domainTrie) insert(domain string, rule *blockRule, exact, subdomains bool) {
+	labels := strings.Split(domain, ".")
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = newDomainTrie()
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	if exact {
+		node.exact = append(node.exact, rule)
+	}
+	if subdomains {
+		node.subdomains = append(node.subdomains, rule)
+	}
+}
+
+// applyingRule returns the first of rules that applies to q, or nil
+func applyingRule(rules []*blockRule, q *ruleQuery) *blockRule {
+	for _, rule := range rules {
+		if rule.applies(q) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// match returns the rule in the trie that matches q, or nil
+func (t *domainTrie) match(q *ruleQuery) *blockRule {
+	host := q.host
+	node := t
+	for end := len(host); end > 0; {
+		start := strings.LastIndexByte(host[:end], '.') + 1
+		child, ok := node.children[host[start:end]]
+		if !ok {
+			return nil
+		}
+		node = child
+		if start == 0 {
+			return applyingRule(node.exact, q)
+		}
+		if rule := applyingRule(node.subdomains, q); rule != nil {
+			return rule
+		}
+		end = start - 1
+	}
+	return nil
+}
+
+// literalDomain matches a domain name written with escaped dots, e.g.
+// "example\.com", as it appears inside the patterns handled by the trie
+const literalDomain = `([A-Za-z0-9_-]+(?:\\.[A-Za-z0-9_-]+)*)`
+
+// Anchored patterns that the trie can answer without running a regexp:
+// "^example\.com$" matches just the domain, "(.*)\.example\.com$" and
+// "\.example\.com$" match its subdomains and "(^|\.)example\.com$" both
+var (
+	exactPattern     = regexp.MustCompile(`^\^` + literalDomain + `\$$`)
+	subdomainPattern = regexp.MustCompile(`^(?:\^?(?:\(\.\*\)|\.\*))?\\\.` + literalDomain + `\$$`)
+	domainPattern    = regexp.MustCompile(`^\(\^\|\\\.\)` + literalDomain + `\$$`)
+)
+
+// addPattern classifies a regular expression and stores it in the trie when
+// it only names a domain, its subdomains or both
+func (ri *ruleIndex) addPattern(pattern string, rule *blockRule) error {
+	if m := exactPattern.FindStringSubmatch(pattern); m != nil {
+		ri.domains.insert(strings.ToLower(strings.ReplaceAll(m[1], `\.`, ".")), rule, true, false)
+		return nil
+	}
+	if m := subdomainPattern.FindStringSubmatch(pattern); m != nil {
+		ri.domains.insert(strings.ToLower(strings.ReplaceAll(m[1], `\.`, ".")), rule, false, true)
+		return nil
+	}
+	if m := domainPattern.FindStringSubmatch(pattern); m != nil {
+		ri.domains.insert(strings.ToLower(strings.ReplaceAll(m[1], `\.`, ".")), rule, true, true)
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	ri.patterns = append(ri.patterns, patternRule{re: re, rule: rule})
+	return nil
+}
+
+// add parses one rule of the list:
+//
+//	example.com      blocks the domain itself
+//	*.example.com    blocks its subdomains
+//	||example.com^   blocks the domain and its subdomains
+//	re:<regexp>      blocks host names the regular expression matches, in lower case
+//	10.0.0.0/8       blocks an IP address or range, see ipfilter.go
+//	@@<rule>         allows the hosts <rule> matches, overriding block rules
+//
+// A rule may be followed by schedule options, see parseSchedule, e.g.
+// "||facebook.com^ days=mon-fri hours=09:00-17:00" only applies in lab hours,
+// and by request options, see parseRequestFilter, e.g.
+// "||dropbox.com^ method=POST,PUT" only blocks uploads
+func (r *blockedRules) add(line, source string) error {
+	fields := strings.Fields(line)
+	var scheduleOptions, filterOptions []string
+	for _, option := range fields[1:] {
+		switch name, _, _ := strings.Cut(option, "="); name {
+		case "method", "path", "query":
+			filterOptions = append(filterOptions, option)
+		default:
+			scheduleOptions = append(scheduleOptions, option)
+		}
+	}
+	sched, err := parseSchedule(scheduleOptions)
+	if err != nil {
+		return err
+	}
+	filter, err := parseRequestFilter(filterOptions)
+	if err != nil {
+		return err
+	}
+	text := fields[0]
+	rule := &blockRule{text: line, list: r.name, source: source, schedule: sched, filter: filter}
+	index := r.block
+	if strings.HasPrefix(text, "@@") {
+		text, rule.allow, index = strings.TrimPrefix(text, "@@"), true, r.allow
+	}
+
+	switch {
+	case strings.HasPrefix(text, "re:"):
+		err = index.addPattern(strings.TrimPrefix(text, "re:"), rule)
+	case strings.HasPrefix(text, "||"):
+		if !strings.HasSuffix(text, "^") {
+			return fmt.Errorf("expected ||domain^, got %q", text)
+		}
+		err = index.addDomain(strings.TrimSuffix(strings.TrimPrefix(text, "||"), "^"), rule, true, true)
+	case strings.HasPrefix(text, "*."):
+		err = index.addDomain(strings.TrimPrefix(text, "*."), rule, false, true)
+	default:
+		if ipNet := parseIPRule(text); ipNet != nil {
+			index.nets = append(index.nets, netRule{ipNet: ipNet, rule: rule})
+		} else {
+			err = index.addDomain(text, rule, true, false)
+		}
+	}
+	if err == nil {
+		r.count++
+	}
+	return err
+}
+
+// addDomain validates a domain name and stores it in the trie
+func (ri *ruleIndex) addDomain(domain string, rule *blockRule, exact, subdomains bool) error {
+	domain = strings.ToLower(domain)
+	if !validDomain(domain) {
+		return fmt.Errorf("invalid domain %q (use re: for a regular expression)", domain)
+	}
+	ri.domains.insert(domain, rule, exact, subdomains)
+	return nil
+}
+
+// validDomain reports whether domain is a plain host name, e.g. "example.com"
+func validDomain(domain string) bool {
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseBlockedDomains reads one rule per line of r. Surrounding whitespace
+// is trimmed, and blank lines and lines starting with '#' are ignored
+// Errors report the file name and line of the rule that failed to parse
+func parseBlockedDomains(name, filename string, r io.Reader) (*blockedRules, error) {
+	rules := newBlockedRules(name)
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", filename, lineNo)
+		if err := rules.add(line, source); err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// Reload reads every list again and replaces the rules with their contents
+// If any list cannot be read or parsed, the current rules are all kept and
+// the error is returned
+func (bs *BlockedSet) Reload() error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	var loaded []*blockedRules
+	for _, list := range bs.lists {
+		rules, err := list.load()
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, rules)
+	}
+	bs.rules.Store(loaded)
+	for _, list := range bs.lists {
+		list.commit()
+	}
+	return nil
+}
+
+// changed reports whether any list file was modified since it was last loaded
+func (bs *BlockedSet) changed() bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	for _, list := range bs.lists {
+		if list.changed() {
 			return true
 		}
 	}
 	return false
 }
+
+// Watch checks the list files for changes each interval and reloads them
+// when one was modified. A file that fails to parse is logged and the old
+// rules stay in place until the file is fixed
+func (bs *BlockedSet) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !bs.changed() {
+			continue
+		}
+		if err := bs.Reload(); err != nil {
+			log.Printf("Error reloading blocked domains, keeping the old lists: %v\n", err)
+
+			// Remember the broken files so the error is logged only once
+			bs.mu.Lock()
+			for _, list := range bs.lists {
+				list.commit()
+			}
+			bs.mu.Unlock()
+			continue
+		}
+		log.Println("Reloaded blocked domains")
+	}
+}
+
+// SetClock replaces the clock rule schedules are evaluated with, so tests
+// can check schedules at fixed times
+func (bs *BlockedSet) SetClock(clock func() time.Time) {
+	bs.clock = clock
+}
+
+// SetDefaultDeny switches between blocking (true) and allowing (false) the
+// hosts that no rule matches
+func (bs *BlockedSet) SetDefaultDeny(deny bool) {
+	bs.defaultDeny.Store(deny)
+}
+
+// Match decides whether the given domain is blocked for clients in no
+// group, considering only rules without request options, see MatchFor
+func (bs *BlockedSet) Match(domain string) (bool, *blockRule) {
+	return bs.MatchFor(domain, nil)
+}
+
+// MatchFor decides whether the given domain is blocked for clients in group,
+// considering only rules without request options, as when all that is known
+// of a request is its host
+func (bs *BlockedSet) MatchFor(domain string, group *clientGroup) (bool, *blockRule) {
+	return bs.match(&ruleQuery{host: domain}, group)
+}
+
+// MatchRequest decides whether req is blocked for clients in group. CONNECT
+// requests only reveal the host, so rules with request options are left
+// out for them rather than blocking the whole tunnel
+func (bs *BlockedSet) MatchRequest(req *http.Request, group *clientGroup) (bool, *blockRule) {
+	q := &ruleQuery{host: req.URL.Hostname(), req: req}
+	if req.Method == "CONNECT" {
+		q.req = nil
+	}
+	return bs.match(q, group)
+}
+
+// match decides whether q is blocked for clients in group and returns the
+// rule that decided it, or nil when no rule matched and the default applied
+// Only the lists selected by the group are consulted, and all of them when
+// group is nil
+// Allow rules of every list are checked first, so they override any block
+// rule. Host names are compared in lower case, without a trailing dot
+func (bs *BlockedSet) match(q *ruleQuery, group *clientGroup) (bool, *blockRule) {
+	q.host = strings.TrimSuffix(strings.ToLower(q.host), ".")
+	q.now = bs.clock()
+	lists := bs.listsFor(group)
+
+	for _, rules := range lists {
+		if rule := rules.allow.match(q); rule != nil {
+			return false, rule
+		}
+	}
+	for _, rules := range lists {
+		if rule := rules.block.match(q); rule != nil {
+			return true, rule
+		}
+	}
+	if group != nil && group.defaultDeny != nil {
+		return *group.defaultDeny, nil
+	}
+	return bs.defaultDeny.Load().(bool), nil
+}
+
+// listsFor returns the loaded lists selected by group, or all of them when
+// group is nil
+func (bs *BlockedSet) listsFor(group *clientGroup) []*blockedRules {
+	var lists []*blockedRules
+	for _, rules := range bs.rules.Load().([]*blockedRules) {
+		if group == nil || group.lists == nil || group.lists[rules.name] {
+			lists = append(lists, rules)
+		}
+	}
+	return lists
+}
+
+// ListNames returns the names of the loaded lists
+func (bs *BlockedSet) ListNames() []string {
+	var names []string
+	for _, list := range bs.lists {
+		names = append(names, list.name)
+	}
+	return names
+}
+
+// IsBlocked checks if the given domain is blocked by the rules in the
+// BlockedSet or, when no rule matches, by default-deny mode
+func (bs *BlockedSet) IsBlocked(domain string) bool {
+	blocked, _ := bs.Match(domain)
+	return blocked
+}
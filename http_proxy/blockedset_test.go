@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestBlockedSet loads a BlockedSet from a list holding lines
+func newTestBlockedSet(t testing.TB, lines ...string) *BlockedSet {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "blocked-domains.txt")
+	if err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := NewBlockedSet(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func TestMatchExactAndSubdomains(t *testing.T) {
+	bs := newTestBlockedSet(t,
+		"exact.example",
+		"*.sub.example",
+		"||both.example^",
+		"re:^ads[0-9]*\\.regexp\\.example$",
+		"@@ok.both.example",
+	)
+	tests := []struct {
+		host    string
+		blocked bool
+	}{
+		{"exact.example", true},
+		{"EXACT.example.", true},
+		{"www.exact.example", false},
+		{"notexact.example", false},
+		{"sub.example", false},
+		{"www.sub.example", true},
+		{"a.b.sub.example", true},
+		{"both.example", true},
+		{"www.both.example", true},
+		{"ok.both.example", false},
+		{"xboth.example", false},
+		{"ads12.regexp.example", true},
+		{"www.regexp.example", false},
+		{"example", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got, _ := bs.Match(tt.host); got != tt.blocked {
+			t.Errorf("Match(%q) = %v, want %v", tt.host, got, tt.blocked)
+		}
+	}
+
+	// The rule deciding a match is reported along with it
+	if _, rule := bs.Match("www.sub.example"); rule == nil || rule.text != "*.sub.example" {
+		t.Errorf("www.sub.example matched %v, want *.sub.example", rule)
+	}
+	if _, rule := bs.Match("ok.both.example"); rule == nil || !rule.allow {
+		t.Errorf("ok.both.example matched %v, want the allow rule", rule)
+	}
+}
+
+func TestMatchDefaultDeny(t *testing.T) {
+	bs := newTestBlockedSet(t, "@@allowed.example")
+	bs.SetDefaultDeny(true)
+	if blocked, rule := bs.Match("other.example"); !blocked || rule != nil {
+		t.Errorf("other.example: blocked %v by %v, want blocked by default", blocked, rule)
+	}
+	if blocked, _ := bs.Match("allowed.example"); blocked {
+		t.Errorf("allowed.example is blocked in default-deny mode")
+	}
+}
+
+// benchmarkMatch measures Match against a list of n domain rules, half of
+// them exact and half covering subdomains, with hosts that hit and miss
+func benchmarkMatch(b *testing.B, n int) {
+	lines := make([]string, n)
+	for i := range lines {
+		if i%2 == 0 {
+			lines[i] = fmt.Sprintf("host%d.example", i)
+		} else {
+			lines[i] = fmt.Sprintf("||host%d.example^", i)
+		}
+	}
+	bs := newTestBlockedSet(b, lines...)
+	hosts := []string{
+		fmt.Sprintf("host%d.example", n/2),
+		fmt.Sprintf("www.host%d.example", n-1),
+		"www.unlisted.example",
+		"deep.sub.domain.not-listed.example",
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bs.Match(hosts[i%len(hosts)])
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	for _, n := range []int{1000, 100000} {
+		b.Run(fmt.Sprintf("%drules", n), func(b *testing.B) {
+			benchmarkMatch(b, n)
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Formats a block list file can be written in
+const (
+	formatRules   = "rules"   // Our own syntax, see blockedRules.add
+	formatHosts   = "hosts"   // Hosts file, "0.0.0.0 example.com" blocks example.com
+	formatDomains = "domains" // One domain per line, blocking it and its subdomains
+	formatABP     = "abp"     // Domain rules of AdBlock Plus filter lists, "||example.com^"
+)
+
+// blockList is one list file loaded into a BlockedSet
+type blockList struct {
+	name     string // Name the list's rules are tagged with
+	format   string
+	filename string
+	url      string // Where the list is fetched from into filename, see remotelists.go
+
+	modTime time.Time   // Modification time of the file last loaded
+	size    int64       // Size of the file last loaded
+	pending os.FileInfo // File read by the last load, remembered by commit
+}
+
+// parseBlockList parses a list given as [name=][format:]path, e.g.
+// "ads=hosts:/etc/ads.hosts". The format defaults to our own rule syntax and
+// the name to the file name without its extension. The path may also be an
+// http or https URL the list is fetched from
+func parseBlockList(spec string) (*blockList, error) {
+	list := &blockList{format: formatRules, filename: spec}
+	// An '=' after a ':' or '/' belongs to the path, e.g. a URL query
+	if i := strings.Index(list.filename, "="); i >= 0 && !strings.ContainsAny(list.filename[:i], ":/") {
+		list.name, list.filename = list.filename[:i], list.filename[i+1:]
+	}
+	if i := strings.Index(list.filename, ":"); i >= 0 {
+		switch format := list.filename[:i]; format {
+		case formatRules, formatHosts, formatDomains, formatABP:
+			list.format, list.filename = format, list.filename[i+1:]
+		}
+	}
+	if list.filename == "" {
+		return nil, fmt.Errorf("invalid block list %q", spec)
+	}
+	if isListURL(list.filename) {
+		list.url = list.filename
+		if list.name == "" {
+			list.name = remoteListName(list.url)
+		}
+		list.filename = remoteListPath(list.name, list.url)
+	}
+	if list.name == "" {
+		base := filepath.Base(list.filename)
+		list.name = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	return list, nil
+}
+
+// load reads and parses the list file. The file's size and modification time
+// are remembered once commit is called
+func (l *blockList) load() (*blockedRules, error) {
+	file, err := os.Open(l.filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	l.pending = info
+
+	rules, skipped, err := l.parse(file)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d rules from %s list %s (%s), skipped %d lines\n",
+		rules.count, l.format, l.name, l.source(), skipped)
+	return rules, nil
+}
+
+// parse parses the list's contents from r and also returns how many lines
+// were skipped. Lists in other formats are usually published by third
+// parties, so a line we cannot use is skipped rather than rejecting the
+// whole list
+func (l *blockList) parse(r io.Reader) (*blockedRules, int, error) {
+	if l.format == formatRules {
+		rules, err := parseBlockedDomains(l.name, l.source(), r)
+		return rules, 0, err
+	}
+	return parseForeignList(l.name, l.source(), l.format, r)
+}
+
+// source is where the list comes from, for rule sources and messages: its
+// URL, or its file
+func (l *blockList) source() string {
+	if l.url != "" {
+		return l.url
+	}
+	return l.filename
+}
+
+// commit remembers the file last loaded, so changed only reports later edits
+func (l *blockList) commit() {
+	if l.pending == nil {
+		if info, err := os.Stat(l.filename); err == nil {
+			l.pending = info
+		}
+	}
+	if l.pending != nil {
+		l.modTime, l.size = l.pending.ModTime(), l.pending.Size()
+		l.pending = nil
+	}
+}
+
+// changed reports whether the file was modified since it was last loaded
+func (l *blockList) changed() bool {
+	info, err := os.Stat(l.filename)
+	if err != nil {
+		return false
+	}
+	return !info.ModTime().Equal(l.modTime) || info.Size() != l.size
+}
+
+// parseForeignList reads a list in the hosts, domains or abp format and
+// returns its rules and the number of lines that were skipped
+func parseForeignList(name, filename, format string, r io.Reader) (*blockedRules, int, error) {
+	rules := newBlockedRules(name)
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		source := fmt.Sprintf("%s:%d", filename, lineNo)
+		var err error
+		switch format {
+		case formatHosts:
+			err = rules.addHostsLine(scanner.Text(), source)
+		case formatDomains:
+			err = rules.addDomainsLine(scanner.Text(), source)
+		case formatABP:
+			err = rules.addABPLine(scanner.Text(), source)
+		}
+		if err != nil {
+			skipped++
+		}
+	}
+	return rules, skipped, scanner.Err()
+}
+
+// hostsIgnored are names every hosts file maps to local addresses, which
+// must not end up blocked
+var hostsIgnored = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// addHostsLine adds the host names of a hosts file line such as
+// "0.0.0.0 ads.example.com tracker.example.com # comment". Each name is
+// blocked exactly, as a hosts file does not cover subdomains
+func (r *blockedRules) addHostsLine(line, source string) error {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	if net.ParseIP(fields[0]) == nil || len(fields) < 2 {
+		return fmt.Errorf("expected an address followed by host names")
+	}
+	var err error
+	for _, host := range fields[1:] {
+		if hostsIgnored[strings.ToLower(host)] {
+			continue
+		}
+		if hostErr := r.addListDomain(host, source, true, false); hostErr != nil {
+			err = hostErr
+		}
+	}
+	return err
+}
+
+// addDomainsLine adds a line of a plain domain list, blocking the domain and
+// its subdomains
+func (r *blockedRules) addDomainsLine(line, source string) error {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+	return r.addListDomain(line, source, true, true)
+}
+
+// addABPLine adds a line of an AdBlock Plus filter list. Only the rules that
+// apply to whole domains are supported: "||example.com^" blocks the domain
+// and its subdomains and "@@||example.com^" allows them. URL patterns,
+// element hiding and rules with options are skipped
+func (r *blockedRules) addABPLine(line, source string) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return nil
+	}
+	domain := strings.TrimPrefix(line, "@@")
+	if !strings.HasPrefix(domain, "||") || !strings.HasSuffix(domain, "^") {
+		return fmt.Errorf("not a domain rule")
+	}
+	return r.add(line, source)
+}
+
+// addListDomain blocks domain as read from a hosts or domains list
+func (r *blockedRules) addListDomain(domain, source string, exact, subdomains bool) error {
+	rule := &blockRule{text: domain, list: r.name, source: source}
+	if err := r.block.addDomain(domain, rule, exact, subdomains); err != nil {
+		return err
+	}
+	r.count++
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultBlockPage is the block page used when no template file is given
+const defaultBlockPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Blocked</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 4em auto; color: #222; }
+h1 { color: #b00; }
+dt { font-weight: bold; margin-top: 0.5em; }
+code { word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>This page is blocked</h1>
+<p>The proxy did not forward your request to <code>{{.URL}}</code>.</p>
+<dl>
+{{if .Rule}}<dt>Rule</dt><dd><code>{{.Rule}}</code> from list {{.List}}</dd>
+{{else}}<dt>Reason</dt><dd>{{.Reason}}</dd>
+{{end}}<dt>Request ID</dt><dd><code>{{.RequestID}}</code></dd>
+<dt>Time</dt><dd>{{.Time.Format "2006-01-02 15:04:05 MST"}}</dd>
+</dl>
+{{if .Contact}}<p>If you think this is a mistake, contact {{.Contact}} and quote the request ID.</p>{{end}}
+</body>
+</html>
+`
+
+// blockPage renders the response sent for blocked requests
+type blockPage struct {
+	tmpl    *template.Template
+	status  int    // 403 Forbidden or 451 Unavailable For Legal Reasons
+	contact string // Who to contact about a block, shown on the page
+}
+
+// blockInfo is what the block page template and JSON response are given
+type blockInfo struct {
+	URL       string    `json:"url"`
+	Host      string    `json:"host"`
+	Rule      string    `json:"rule,omitempty"`   // The matched rule, empty under default-deny
+	List      string    `json:"list,omitempty"`   // Name of the list the rule belongs to
+	Source    string    `json:"source,omitempty"` // File and line of the rule
+	Group     string    `json:"group"`            // Client group whose lists applied
+	Reason    string    `json:"reason"`
+	RequestID string    `json:"request_id"`
+	Contact   string    `json:"contact,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// newBlockPage loads the block page template from filename, or uses the
+// built-in page when filename is empty. status must be 403 or 451
+func newBlockPage(filename string, status int, contact string) (*blockPage, error) {
+	if status != http.StatusForbidden && status != http.StatusUnavailableForLegalReasons {
+		return nil, fmt.Errorf("block status must be 403 or 451, got %d", status)
+	}
+	var tmpl *template.Template
+	var err error
+	if filename == "" {
+		tmpl, err = template.New("block").Parse(defaultBlockPage)
+	} else {
+		tmpl, err = template.ParseFiles(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &blockPage{tmpl: tmpl, status: status, contact: contact}, nil
+}
+
+// newRequestID returns a random identifier for a request, which is shown on
+// the block page and logged so a complaint can be matched with the log
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// wantsJSON reports whether the client prefers JSON to HTML, as API clients
+// sending "Accept: application/json" do
+func wantsJSON(req *http.Request) bool {
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return true
+		case "text/html", "application/xhtml+xml":
+			return false
+		}
+	}
+	return false
+}
+
+// blockReason says why a request was blocked: by rule, or by default-deny
+// mode when rule is nil
+func blockReason(rule *blockRule) string {
+	if rule == nil {
+		return "not allowed by default-deny mode"
+	}
+	return "blocked by rule"
+}
+
+// serve responds to a blocked request with the block page, or with JSON for
+// clients that ask for it. rule is nil when default-deny mode blocked the
+// request. It returns the request ID shown to the client
+func (bp *blockPage) serve(w http.ResponseWriter, req *http.Request, rule *blockRule, group string) string {
+	info := blockInfo{
+		URL:       req.URL.String(),
+		Host:      req.URL.Hostname(),
+		Group:     group,
+		Reason:    blockReason(rule),
+		RequestID: newRequestID(),
+		Contact:   bp.contact,
+		Time:      time.Now(),
+	}
+	if req.Method == "CONNECT" {
+		info.URL = req.URL.Host
+	}
+	if rule != nil {
+		info.Rule, info.List, info.Source = rule.text, rule.list, rule.source
+	}
+
+	w.Header().Set("X-Request-Id", info.RequestID)
+	w.Header().Set("Cache-Control", "no-store")
+	if wantsJSON(req) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(bp.status)
+		json.NewEncoder(w).Encode(info)
+		return info.RequestID
+	}
+
+	var page bytes.Buffer
+	if err := bp.tmpl.Execute(&page, info); err != nil {
+		log.Printf("Error rendering block page: %v\n", err)
+		http.Error(w, "Forbidden Content", bp.status)
+		return info.RequestID
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(bp.status)
+	w.Write(page.Bytes())
+	return info.RequestID
+}
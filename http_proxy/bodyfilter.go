@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// defaultScanLimit is how much of a text body is scanned when the filters
+// file sets no scan-limit
+const defaultScanLimit = 1 << 20
+
+// scanOverlap is how much text from the end of one chunk is scanned again
+// with the next, so a phrase split across chunks is still found. Matches
+// longer than this may be missed when they cross a chunk boundary
+const scanOverlap = 4096
+
+// bodyRule blocks text responses whose body matches a regular expression
+type bodyRule struct {
+	re   *regexp.Regexp
+	rule *blockRule
+}
+
+// keywordRegexp compiles a keyword phrase into a case-insensitive regexp in
+// which any run of white space matches any other, as HTML wraps text freely
+func keywordRegexp(phrase string) *regexp.Regexp {
+	words := strings.Fields(phrase)
+	for i, word := range words {
+		words[i] = regexp.QuoteMeta(word)
+	}
+	return regexp.MustCompile(`(?i)` + strings.Join(words, `\s+`))
+}
+
+// addBodyRule adds a keyword or regex directive; value is the rest of the
+// line after the directive
+func (f *responseFilters) addBodyRule(directive, value string, rule *blockRule) error {
+	var re *regexp.Regexp
+	if directive == "keyword" {
+		re = keywordRegexp(value)
+	} else {
+		var err error
+		if re, err = regexp.Compile(value); err != nil {
+			return fmt.Errorf("invalid regex %q: %v", value, err)
+		}
+	}
+	f.bodies = append(f.bodies, bodyRule{re: re, rule: rule})
+	return nil
+}
+
+// scanBody sets resp up to be scanned for the keyword and regex rules if
+// it is a text/* response, and returns the rule that matched the part of
+// the body scanned before anything is passed on, or nil: the first chunk of
+// a plain body, or all of the text a compressed body is scanned for. The
+// rest of a plain body is scanned as it is read, see scanningBody, so it
+// streams to the client; a match found there ends the body with a
+// blockedResponseError
+func (f *responseFilters) scanBody(req *http.Request, resp *http.Response) *blockRule {
+	if len(f.bodies) == 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "text/") {
+		return nil
+	}
+
+	body := &scanningBody{
+		ReadCloser: resp.Body,
+		f:          f,
+		url:        req.URL.String(),
+		encoding:   strings.ToLower(resp.Header.Get("Content-Encoding")),
+		chunk:      make([]byte, 32*1024),
+	}
+	resp.Body = body
+
+	// Scan the first chunk now, while a match can still get the block page
+	body.fill()
+	var blocked *blockedResponseError
+	if errors.As(body.err, &blocked) {
+		return blocked.rule
+	}
+	return nil
+}
+
+// scanningBody passes a text body on while scanning it. A plain body is
+// passed on a chunk at a time, each chunk after it was scanned; only the
+// start of a match spanning two chunks can reach the client before the
+// match is found. Gzip and deflate bodies are decompressed for scanning but
+// passed on as received, and since a few compressed bytes can stand for
+// much more text than a chunk, nothing of them is passed on until all the
+// text to scan was scanned. A body that cannot be decoded is blocked rather
+// than passed on unscanned. Once scanLimit bytes of text were scanned, or
+// the text ends, the rest of the body passes through as it is
+type scanningBody struct {
+	io.ReadCloser // The body as received, still encoded
+
+	f        *responseFilters
+	url      string
+	encoding string       // Content-Encoding, in lower case
+	text     io.Reader    // The decoded text, created on the first scan
+	rawErr   error        // Last error reading the body as received
+	pending  bytes.Buffer // Bytes already scanned, not yet passed on
+	chunk    []byte
+	window   []byte // End of the text scanned so far, see scanOverlap
+	scanned  int64
+	done     bool  // Scanning has finished
+	err      error // Ends the body once pending is passed on
+}
+
+func (b *scanningBody) Read(p []byte) (int, error) {
+	b.fill()
+	if b.pending.Len() > 0 {
+		return b.pending.Read(p)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// fill scans until there are scanned bytes to pass on or scanning is done
+// The bytes of a compressed body are held back until scanning is done
+func (b *scanningBody) fill() {
+	compressed := b.encoding != "" && b.encoding != "identity"
+	for !b.done && (b.pending.Len() == 0 || compressed) {
+		b.scan()
+	}
+}
+
+// readRaw reads the body as received for the decoder, keeping what it reads
+// to pass on and the error it got
+func (b *scanningBody) readRaw(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.pending.Write(p[:n])
+	b.rawErr = err
+	return n, err
+}
+
+// scan reads and scans the next chunk of text
+func (b *scanningBody) scan() {
+	if b.text == nil {
+		raw := readerFunc(b.readRaw)
+		var err error
+		switch b.encoding {
+		case "", "identity":
+			b.text = raw
+		case "gzip", "x-gzip":
+			b.text, err = gzip.NewReader(raw)
+		case "deflate":
+			b.text, err = zlib.NewReader(raw)
+		default:
+			err = fmt.Errorf("unsupported Content-Encoding %q", b.encoding)
+		}
+		if err != nil {
+			b.stop(err)
+			return
+		}
+	}
+
+	chunk := b.chunk
+	if left := b.f.scanLimit - b.scanned; left < int64(len(chunk)) {
+		chunk = chunk[:left]
+	}
+	n, err := b.text.Read(chunk)
+	if n > 0 {
+		b.scanned += int64(n)
+		b.window = append(b.window, chunk[:n]...)
+		for _, r := range b.f.bodies {
+			if r.re.Match(b.window) {
+				b.pending.Reset()
+				b.done, b.err = true, &blockedResponseError{url: b.url, rule: r.rule}
+				return
+			}
+		}
+		if len(b.window) > scanOverlap {
+			b.window = append(b.window[:0], b.window[len(b.window)-scanOverlap:]...)
+		}
+	}
+	switch {
+	case err == io.EOF || b.scanned >= b.f.scanLimit:
+		b.done = true
+	case err != nil:
+		b.stop(err)
+	}
+}
+
+// stop ends scanning after err. An error reading the body, such as the size
+// limit cutting it, ends it after what was scanned; an error decoding it
+// blocks it, since what it says cannot be checked
+func (b *scanningBody) stop(err error) {
+	b.done = true
+	if b.rawErr != nil && b.rawErr != io.EOF {
+		b.err = b.rawErr
+		return
+	}
+	log.Printf("Blocking %s: cannot scan its body: %v\n", b.url, err)
+	b.pending.Reset()
+	b.err = &blockedResponseError{url: b.url, rule: b.f.undecodable}
+}
+
+// readerFunc turns a function into an io.Reader
+type readerFunc func(p []byte) (int, error)
+
+func (r readerFunc) Read(p []byte) (int, error) {
+	return r(p)
+}
+
+// restrictEncodings limits the Accept-Encoding of a request to the codings
+// the body scanner can decode, when there are body rules, so origins do not
+// send text that would have to be blocked as unscannable
+func (f *responseFilters) restrictEncodings(header http.Header) {
+	if len(f.bodies) == 0 || header.Get("Accept-Encoding") == "" {
+		return
+	}
+	var kept []string
+	for _, coding := range strings.Split(header.Get("Accept-Encoding"), ",") {
+		name, _, _ := strings.Cut(coding, ";")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip", "x-gzip", "deflate", "identity":
+			kept = append(kept, strings.TrimSpace(coding))
+		}
+	}
+	if len(kept) == 0 {
+		header.Del("Accept-Encoding")
+		return
+	}
+	header.Set("Accept-Encoding", strings.Join(kept, ", "))
+}
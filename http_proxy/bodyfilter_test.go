@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestFilters loads response filters from a file holding lines
+func newTestFilters(t *testing.T, lines ...string) *responseFilters {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "response-filters.txt")
+	if err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := loadResponseFilters(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// encodeBody compresses text with the given Content-Encoding
+func encodeBody(t *testing.T, encoding, text string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "":
+		return []byte(text)
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	}
+	io.WriteString(w, text)
+	w.Close()
+	return buf.Bytes()
+}
+
+// textResponse returns a text/html response with the given encoded body
+func textResponse(encoding string, body []byte) *http.Response {
+	header := http.Header{"Content-Type": {"text/html"}}
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	}
+	return &http.Response{
+		StatusCode:    200,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+// decodeBody decompresses what a client received, ignoring a cut-off end
+func decodeBody(encoding string, body []byte) string {
+	var r io.Reader = bytes.NewReader(body)
+	var err error
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(r)
+	case "deflate":
+		r, err = zlib.NewReader(r)
+	}
+	if err != nil {
+		return ""
+	}
+	text, _ := io.ReadAll(r)
+	return string(text)
+}
+
+func TestScanBody(t *testing.T) {
+	f := newTestFilters(t, "keyword bad word")
+	chunk := 32 * 1024
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"first chunk", "<p>a bad word</p>" + strings.Repeat("x", 3*chunk)},
+		{"later chunk", strings.Repeat("x", 2*chunk+100) + "bad word" + strings.Repeat("x", chunk)},
+		{"across chunks", strings.Repeat("x", chunk-4) + "bad word" + strings.Repeat("x", chunk)},
+		// A match as long as scanOverlap, half of it in each chunk
+		{"across the overlap", strings.Repeat("x", chunk-scanOverlap/2) + "bad" + strings.Repeat(" ", scanOverlap-7) + "word" + strings.Repeat("x", chunk)},
+		{"clean", strings.Repeat("x", 3*chunk) + "badly worded, but bad and word apart"},
+	}
+	for _, encoding := range []string{"", "gzip", "deflate"} {
+		for _, tt := range tests {
+			req, _ := http.NewRequest("GET", "http://example.com/page", nil)
+			resp := textResponse(encoding, encodeBody(t, encoding, tt.text))
+			rule, _ := f.apply(req, resp)
+			received, err := io.ReadAll(resp.Body)
+
+			var blocked *blockedResponseError
+			switch {
+			case tt.name == "clean":
+				if rule != nil || err != nil {
+					t.Errorf("%q %s: blocked by %v, %v", encoding, tt.name, rule, err)
+				}
+				if got := decodeBody(encoding, received); got != tt.text {
+					t.Errorf("%q %s: client got %d bytes of text, want %d", encoding, tt.name, len(got), len(tt.text))
+				}
+				continue
+			case rule != nil:
+				// Blocked before anything was passed on
+			case errors.As(err, &blocked):
+				// Blocked while streaming; what was passed on must not
+				// hold the match
+				if encoding != "" || tt.name == "first chunk" {
+					t.Errorf("%q %s: blocked while streaming, want the block page", encoding, tt.name)
+				}
+			default:
+				t.Errorf("%q %s: not blocked", encoding, tt.name)
+				continue
+			}
+			if strings.Contains(decodeBody(encoding, received), "word") {
+				t.Errorf("%q %s: the match reached the client", encoding, tt.name)
+			}
+		}
+	}
+}
+
+func TestScanBodyUndecodable(t *testing.T) {
+	f := newTestFilters(t, "keyword bad word")
+	for _, encoding := range []string{"gzip", "deflate", "br"} {
+		req, _ := http.NewRequest("GET", "http://example.com/page", nil)
+		resp := textResponse(encoding, []byte("not compressed, with a bad word"))
+		if rule, _ := f.apply(req, resp); rule != f.undecodable {
+			t.Errorf("%s body that does not decode: got rule %v, want it blocked as undecodable", encoding, rule)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// putBody caches body as the response to a GET for rawURL
+func putBody(t *testing.T, c *HTTPCache, rawURL, body string) {
+	t.Helper()
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}
+	c.Put(req, resp, 60, "na")
+}
+
+// getBody returns the cached body for rawURL, failing the test on a miss
+func getBody(t *testing.T, c *HTTPCache, rawURL string) string {
+	t.Helper()
+	req, _ := http.NewRequest("GET", rawURL, nil)
+	resp, found := c.Get(req)
+	if !found {
+		t.Fatalf("%s is not cached", rawURL)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+// checkRefs compares the blob reference counts with the records on disk
+func checkRefs(t *testing.T, c *HTTPCache) {
+	t.Helper()
+	want := make(map[string]int)
+	files, err := os.ReadDir(c.cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		entry, err := c.readEntry(f.Name())
+		if err != nil {
+			t.Fatalf("record %s: %v", f.Name(), err)
+		}
+		want[entry.BodyHash]++
+	}
+
+	c.blobs.mu.Lock()
+	defer c.blobs.mu.Unlock()
+	for hash, n := range c.blobs.refs {
+		if n != want[hash] {
+			t.Errorf("blob %s has %d references, %d records use it", hash, n, want[hash])
+		}
+	}
+	for hash, n := range want {
+		if c.blobs.refs[hash] != n {
+			t.Errorf("blob %s is used by %d records, has %d references", hash, n, c.blobs.refs[hash])
+		}
+	}
+}
+
+func TestSharedBlobRefcounts(t *testing.T) {
+	c := newHTTPCacheAt(t.TempDir())
+	putBody(t, c, "http://a.example/", "shared")
+	putBody(t, c, "http://b.example/", "shared")
+	checkRefs(t, c)
+	if got := c.DedupStats(); got.Blobs != 1 || got.References != 2 {
+		t.Fatalf("got %d blobs and %d references, want 1 and 2", got.Blobs, got.References)
+	}
+
+	// Replacing one URL's body keeps the blob the other still uses
+	putBody(t, c, "http://a.example/", "changed")
+	checkRefs(t, c)
+	c.CollectGarbage()
+	if got := getBody(t, c, "http://b.example/"); got != "shared" {
+		t.Fatalf("b.example body is %q after GC, want %q", got, "shared")
+	}
+}
+
+func TestConcurrentPutsKeepSharedBlob(t *testing.T) {
+	c := newHTTPCacheAt(t.TempDir())
+	putBody(t, c, "http://a.example/", "shared")
+	putBody(t, c, "http://b.example/", "shared")
+
+	// Concurrent Puts replacing a.example must each release the body they
+	// replaced exactly once
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := "shared"
+			if i%2 == 0 {
+				body = "other"
+			}
+			putBody(t, c, "http://a.example/", body)
+		}(i)
+	}
+	wg.Wait()
+	checkRefs(t, c)
+
+	removed, _ := c.CollectGarbage()
+	if got := getBody(t, c, "http://b.example/"); got != "shared" {
+		t.Fatalf("b.example body is %q after GC removed %d blobs, want %q", got, removed, "shared")
+	}
+}
+
+func TestCollectGarbageRemovesUnreferenced(t *testing.T) {
+	c := newHTTPCacheAt(t.TempDir())
+	putBody(t, c, "http://a.example/", "first")
+	putBody(t, c, "http://a.example/", "second")
+
+	removed, _ := c.CollectGarbage()
+	if removed != 1 {
+		t.Fatalf("GC removed %d blobs, want 1", removed)
+	}
+	if _, err := os.Stat(c.blobs.path(blobHash([]byte("first")))); !os.IsNotExist(err) {
+		t.Fatalf("unreferenced blob still on disk: %v", err)
+	}
+	if got := getBody(t, c, "http://a.example/"); got != "second" {
+		t.Fatalf("body is %q, want %q", got, "second")
+	}
+}
+
+func TestStatsTrackStoredRecords(t *testing.T) {
+	dir := t.TempDir()
+	c := newHTTPCacheAt(dir)
+	putBody(t, c, "http://a.example/", "first")
+	putBody(t, c, "http://a.example/", "second")
+	putBody(t, c, "http://b.example/", "other")
+
+	stats := c.Stats()
+	if stats.Objects != 2 || stats.Replacements != 1 {
+		t.Fatalf("got %d objects and %d replacements, want 2 and 1", stats.Objects, stats.Replacements)
+	}
+	if got := stats.Hosts["a.example"].Objects; got != 1 {
+		t.Fatalf("a.example has %d objects, want 1", got)
+	}
+
+	// A restarted cache counts the records already on disk
+	if got := newHTTPCacheAt(dir).Stats(); got.Objects != 2 || got.DiskBytes != stats.DiskBytes {
+		t.Fatalf("after restart got %d objects and %d bytes, want 2 and %d", got.Objects, got.DiskBytes, stats.DiskBytes)
+	}
+
+	c.quarantine(c.CacheKey(mustRequest(t, "http://b.example/")), io.ErrUnexpectedEOF)
+	if got := c.Stats(); got.Objects != 1 || got.Hosts["b.example"].Objects != 0 {
+		t.Fatalf("after quarantine got %d objects, %d for b.example, want 1 and 0", got.Objects, got.Hosts["b.example"].Objects)
+	}
+}
+
+// mustRequest returns a GET request for rawURL
+func mustRequest(t *testing.T, rawURL string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestScrubDuringPutsQuarantinesNothing(t *testing.T) {
+	c := newHTTPCacheAt(t.TempDir())
+	putBody(t, c, "http://a.example/", "first")
+
+	// Records are replaced while they are scrubbed; a reader must never
+	// see one half written
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			putBody(t, c, "http://a.example/", strings.Repeat("x", i*100))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if report := c.Scrub(); report.Quarantined != 0 {
+			<-done
+			t.Fatalf("scrub quarantined %d files during puts", report.Quarantined)
+		}
+	}
+}
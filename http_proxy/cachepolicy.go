@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cachePolicy overrides the caching decision the proxy derives from the
+// response headers, for URLs matching a host and optional path pattern
+// TTLs are in seconds; -1 means the override is not set
+type cachePolicy struct {
+	urlPattern
+	forceTTL      int64 // Cache every response for exactly this long
+	minTTL        int64 // Cache responses for at least this long
+	maxTTL        int64 // Cache responses for at most this long
+	ignoreNoCache bool  // Let minTTL apply to no-cache responses as well
+	neverCache    bool  // Never store responses
+	ignoreQuery   bool  // Cache responses without regard to the query string
+}
+
+// cachePolicies is the ordered list of policy rules; the first rule whose
+// pattern matches a URL applies
+type cachePolicies struct {
+	rules []*cachePolicy
+}
+
+// loadCachePolicies reads policy rules from filename. Each line holds a
+// pattern followed by one or more directives, e.g.
+//
+//	*.cdn.example.com/static/*  min-ttl=86400 ignore-no-cache
+//
+// The pattern is parsed by parseURLPattern. The directives are
+// force-ttl=N, min-ttl=N, max-ttl=N, ignore-no-cache, never-cache and
+// ignore-query. Blank lines and lines starting with '#' are ignored
+// A missing file means no overrides
+func loadCachePolicies(filename string) (*cachePolicies, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return &cachePolicies{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []*cachePolicy
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseCachePolicy(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineNo, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d cache policy rules from %s\n", len(rules), filename)
+	return &cachePolicies{rules: rules}, nil
+}
+
+// parseCachePolicy builds a rule from the fields of one line of the rules file
+func parseCachePolicy(fields []string) (*cachePolicy, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected a pattern followed by directives")
+	}
+	pattern, err := parseURLPattern(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	rule := &cachePolicy{urlPattern: pattern, forceTTL: -1, minTTL: -1, maxTTL: -1}
+
+	for _, directive := range fields[1:] {
+		name, value := directive, ""
+		if i := strings.Index(directive, "="); i >= 0 {
+			name, value = directive[:i], directive[i+1:]
+		}
+		var ttl *int64
+		switch name {
+		case "force-ttl":
+			ttl = &rule.forceTTL
+		case "min-ttl":
+			ttl = &rule.minTTL
+		case "max-ttl":
+			ttl = &rule.maxTTL
+		case "ignore-no-cache":
+			rule.ignoreNoCache = true
+		case "never-cache":
+			rule.neverCache = true
+		case "ignore-query":
+			rule.ignoreQuery = true
+		default:
+			return nil, fmt.Errorf("unknown directive %q", directive)
+		}
+		if ttl != nil {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds < 0 {
+				return nil, fmt.Errorf("%s needs a number of seconds", name)
+			}
+			*ttl = seconds
+		} else if value != "" {
+			return nil, fmt.Errorf("%s takes no value", name)
+		}
+	}
+	return rule, nil
+}
+
+// match returns the first rule that applies to u, or nil if none does
+func (cp *cachePolicies) match(u *url.URL) *cachePolicy {
+	for _, rule := range cp.rules {
+		if rule.matches(u) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// apply adjusts the caching decision derived from the response headers
+// It returns whether to store the response and its max-age in seconds
+// (-1 meaning it is refetched on every use). A nil policy changes
+// nothing, and no rule can make a no-store or private response cacheable
+func (rule *cachePolicy) apply(header http.Header, cacheable bool, maxAge int64) (bool, int64) {
+	if rule == nil {
+		return cacheable, maxAge
+	}
+	if rule.neverCache {
+		return false, -1
+	}
+	cacheControl := header.Get("Cache-Control")
+	if strings.Contains(cacheControl, "no-store") || strings.Contains(cacheControl, "private") {
+		return cacheable, maxAge
+	}
+	if rule.forceTTL >= 0 {
+		return true, rule.forceTTL
+	}
+
+	// A no-cache response keeps the max-age it came with, or is refetched
+	// on every use without one; a minimum TTL only raises that when the
+	// rule ignores no-cache
+	noCache := strings.Contains(cacheControl, "no-cache")
+	if rule.minTTL >= 0 && maxAge < rule.minTTL && (!noCache || rule.ignoreNoCache) {
+		cacheable, maxAge = true, rule.minTTL
+	}
+	if rule.maxTTL >= 0 && maxAge > rule.maxTTL {
+		maxAge = rule.maxTTL
+	}
+	return cacheable, maxAge
+}
+
+// keyRequest returns the request to use for cache lookups and stores, which
+// is req itself unless the rule ignores the query string
+func (rule *cachePolicy) keyRequest(req *http.Request) *http.Request {
+	if rule == nil || !rule.ignoreQuery || req.URL.RawQuery == "" {
+		return req
+	}
+	keyReq := *req
+	u := *req.URL
+	u.RawQuery = ""
+	keyReq.URL = &u
+	return &keyReq
+}
+
+// cacheStatusParams appends a detail naming the rule to the given
+// Cache-Status parameters, so overrides are visible to clients
+func (rule *cachePolicy) cacheStatusParams(params ...string) []string {
+	if rule == nil {
+		return params
+	}
+	return append(params, "detail="+strconv.Quote("policy "+rule.pattern))
+}
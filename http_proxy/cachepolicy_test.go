@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNoCacheKeepsMaxAge(t *testing.T) {
+	plain, err := parseCachePolicy([]string{"a.example", "min-ttl=600"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignoring, err := parseCachePolicy([]string{"a.example", "min-ttl=600", "ignore-no-cache"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cacheControl string
+		rule         *cachePolicy
+		cacheable    bool
+		maxAge       int64
+	}{
+		{"no-cache, max-age=60", nil, true, 60},
+		{"no-cache", nil, true, -1},
+		{"public, max-age=60", nil, true, 60},
+		{"no-cache, max-age=60", plain, true, 60},
+		{"no-cache", plain, true, -1},
+		{"public, max-age=60", plain, true, 600},
+		{"no-cache, max-age=60", ignoring, true, 600},
+		{"no-cache", ignoring, true, 600},
+	}
+	for _, tt := range tests {
+		header := http.Header{"Cache-Control": {tt.cacheControl}}
+		cacheable, maxAge, _ := parseCacheHeaders(header)
+		cacheable, maxAge = tt.rule.apply(header, cacheable, maxAge)
+		if cacheable != tt.cacheable || maxAge != tt.maxAge {
+			t.Errorf("%q with %v: got %v, %d, want %v, %d", tt.cacheControl, tt.rule, cacheable, maxAge, tt.cacheable, tt.maxAge)
+		}
+	}
+}
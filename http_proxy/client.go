@@ -1,3 +1,5 @@
+//go:build ignore
+
 /// To start the client application, run "go run client.go URL"
 // while the server is running too on a separate terminal
 // Ex. go run client.go http://go.com
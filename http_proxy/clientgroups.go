@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// clientGroup applies its own selection of block lists to some clients, e.g.
+// the lab network, guest Wi-Fi or staff accounts
+type clientGroup struct {
+	name        string
+	nets        []*net.IPNet    // Client address ranges in the group
+	users       map[string]bool // Authenticated users in the group
+	lists       map[string]bool // Names of the block lists applied; nil means all lists
+	defaultDeny *bool           // Overrides the global default mode when set
+}
+
+// clientGroups is the ordered list of groups; the first group matching a
+// client applies. Clients no group matches get every list
+type clientGroups struct {
+	groups []*clientGroup
+}
+
+// loadClientGroups reads the groups from filename. Each line holds a group
+// name, the clients in it and its directives, e.g.
+//
+//	lab    10.1.0.0/16,10.2.0.5    lists=blocked-domains,social
+//	guest  192.168.50.0/24         lists=blocked-domains,ads default=deny
+//	staff  user:alice,user:bob     lists=blocked-domains
+//
+// Clients are CIDR ranges, single addresses or user:<name> for users who
+// logged in with proxy authentication. The directives are lists=<names>,
+// naming the block lists to apply, and default=allow|deny. Blank lines and
+// lines starting with '#' are ignored. A missing file means no groups
+func loadClientGroups(filename string, listNames []string) (*clientGroups, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return &clientGroups{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	known := make(map[string]bool)
+	for _, name := range listNames {
+		known[name] = true
+	}
+
+	var groups []*clientGroup
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		group, err := parseClientGroup(strings.Fields(line), known)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineNo, err)
+		}
+		groups = append(groups, group)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d client groups from %s\n", len(groups), filename)
+	return &clientGroups{groups: groups}, nil
+}
+
+// parseClientGroup builds a group from the fields of one line of the groups
+// file. known holds the names of the block lists that are loaded
+func parseClientGroup(fields []string, known map[string]bool) (*clientGroup, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected a group name followed by clients")
+	}
+	group := &clientGroup{name: fields[0], users: make(map[string]bool)}
+
+	for _, client := range strings.Split(fields[1], ",") {
+		switch {
+		case strings.HasPrefix(client, "user:"):
+			group.users[strings.TrimPrefix(client, "user:")] = true
+		case strings.Contains(client, "/"):
+			_, ipNet, err := net.ParseCIDR(client)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client range %q", client)
+			}
+			group.nets = append(group.nets, ipNet)
+		default:
+			ip := net.ParseIP(client)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid client %q", client)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			group.nets = append(group.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+
+	for _, directive := range fields[2:] {
+		name, value, _ := strings.Cut(directive, "=")
+		switch name {
+		case "lists":
+			group.lists = make(map[string]bool)
+			for _, list := range strings.Split(value, ",") {
+				if !known[list] {
+					return nil, fmt.Errorf("unknown block list %q", list)
+				}
+				group.lists[list] = true
+			}
+		case "default":
+			if value != "allow" && value != "deny" {
+				return nil, fmt.Errorf("default must be allow or deny")
+			}
+			deny := value == "deny"
+			group.defaultDeny = &deny
+		default:
+			return nil, fmt.Errorf("unknown directive %q", directive)
+		}
+	}
+	return group, nil
+}
+
+// match returns the first group containing the client at ip, or user if
+// the client authenticated, and nil if none does
+func (cg *clientGroups) match(ip net.IP, user string) *clientGroup {
+	for _, group := range cg.groups {
+		if user != "" && group.users[user] {
+			return group
+		}
+		for _, ipNet := range group.nets {
+			if ip != nil && ipNet.Contains(ip) {
+				return group
+			}
+		}
+	}
+	return nil
+}
+
+// proxyUsers holds the accounts clients authenticate with when proxy
+// authentication is enabled
+type proxyUsers struct {
+	passwords map[string]string // Password, or a salted hash of it, see hashPassword
+}
+
+// loadProxyUsers reads user:password lines from filename. A password may be
+// given as "sha256:<salt>:<digest>" instead of in the clear, as printed by
+// the -hash-password flag. Blank lines and lines starting with '#' are
+// ignored
+func loadProxyUsers(filename string) (*proxyUsers, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := &proxyUsers{passwords: make(map[string]string)}
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, password, ok := strings.Cut(line, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:password", filename, lineNo)
+		}
+		if strings.HasPrefix(password, "sha256:") && !validPasswordHash(password) {
+			return nil, fmt.Errorf("%s:%d: expected sha256:<salt>:<digest> in hex, generate it with -hash-password", filename, lineNo)
+		}
+		users.passwords[name] = password
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d proxy users from %s\n", len(users.passwords), filename)
+	return users, nil
+}
+
+// check reports whether password is correct for user
+func (pu *proxyUsers) check(user, password string) bool {
+	stored, ok := pu.passwords[user]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(stored, "sha256:") {
+		parts := strings.Split(stored, ":")
+		salt, _ := hex.DecodeString(parts[1])
+		password, stored = saltedDigest(salt, password), strings.ToLower(parts[2])
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(stored)) == 1
+}
+
+// hashPassword returns the users file entry for password:
+// "sha256:<salt>:<digest>", where digest is the SHA-256 of a random salt
+// followed by the password, both in hex. The salt keeps equal passwords
+// from having equal entries
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(salt) + ":" + saltedDigest(salt, password), nil
+}
+
+// saltedDigest returns the hex SHA-256 of salt followed by password
+func saltedDigest(salt []byte, password string) string {
+	sum := sha256.Sum256(append(append([]byte{}, salt...), password...))
+	return hex.EncodeToString(sum[:])
+}
+
+// validPasswordHash reports whether entry is a well-formed
+// "sha256:<salt>:<digest>" users file entry
+func validPasswordHash(entry string) bool {
+	parts := strings.Split(entry, ":")
+	if len(parts) != 3 || parts[1] == "" {
+		return false
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return false
+	}
+	digest, err := hex.DecodeString(parts[2])
+	return err == nil && len(digest) == sha256.Size
+}
+
+// authenticate checks the Proxy-Authorization header of req and returns the
+// user name. Clients without valid credentials get a 407 response asking
+// for them. With proxy authentication disabled every request passes with
+// an empty user name
+func (p *forwardProxy) authenticate(w http.ResponseWriter, req *http.Request) (string, bool) {
+	if p.users == nil {
+		return "", true
+	}
+	// The header is parsed like Authorization, which BasicAuth reads
+	auth := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+	if user, password, ok := auth.BasicAuth(); ok && p.users.check(user, password) {
+		return user, true
+	}
+	w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+	http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+	log.Println("Proxy Authentication Required")
+	return "", false
+}
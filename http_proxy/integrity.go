@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scrubReport summarizes a pass over the whole cache store
+type scrubReport struct {
+	Entries     int `json:"entries"`     // Metadata records checked
+	Blobs       int `json:"blobs"`       // Stored bodies checked
+	Quarantined int `json:"quarantined"` // Records and bodies moved to quarantine
+}
+
+// verifyEntry checks a cached body against the checksum, size and
+// Content-Length recorded with it. Records written before bodies were
+// deduplicated carry no checksum and only get the Content-Length check
+func verifyEntry(entry *CacheEntry, body []byte) error {
+	if entry.BodyHash != "" {
+		if int64(len(body)) != entry.BodySize {
+			return fmt.Errorf("body is %d bytes, expected %d", len(body), entry.BodySize)
+		}
+		if sum := blobHash(body); sum != entry.BodyHash {
+			return fmt.Errorf("body checksum %s does not match %s", sum, entry.BodyHash)
+		}
+	}
+	if cl := entry.Header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.Atoi(cl); err == nil && n != len(body) {
+			return fmt.Errorf("body is %d bytes, Content-Length is %d", len(body), n)
+		}
+	}
+	return nil
+}
+
+// writeRecord stores the metadata record data under key. It is written to a
+// temporary file first and renamed into place, so a concurrent Get or Scrub,
+// or the next start after a crash, sees either the old record or the new
+// one and never quarantines a half-written record
+func (c *HTTPCache) writeRecord(key string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Join(c.cacheDir, "tmp"), key+"-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(c.cacheDir, key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// quarantinePath returns where a corrupt file called name is moved to
+func quarantinePath(cacheDir, name string) string {
+	dir := filepath.Join(cacheDir, "quarantine")
+	os.MkdirAll(dir, os.ModePerm)
+	return filepath.Join(dir, name+"."+time.Now().Format("20060102T150405.000000000"))
+}
+
+// quarantine moves the metadata record stored under key out of the cache so
+// the next request refetches the response, and releases its body
+// The file is kept for inspection rather than deleted
+func (c *HTTPCache) quarantine(key string, reason error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, err := c.readEntry(key); err == nil && entry.BodyHash != "" {
+		c.blobs.release(entry.BodyHash)
+	}
+	err := os.Rename(filepath.Join(c.cacheDir, key), quarantinePath(c.cacheDir, key))
+	if err != nil {
+		log.Printf("Error quarantining cache file (%s): %v\n", key, err)
+		return
+	}
+	c.forgetKey(key)
+	c.stats.recordRemoved(key)
+	log.Printf("Quarantined corrupt cache file (%s): %v\n", key, reason)
+}
+
+// quarantine moves a corrupt blob out of the store, so the next put of the
+// same content writes a good copy. Records still referring to it are
+// quarantined as they are read
+func (b *blobStore) quarantine(hash string, reason error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := os.Rename(b.path(hash), quarantinePath(filepath.Dir(b.dir), "blob-"+hash))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error quarantining blob (%s): %v\n", hash, err)
+		return
+	}
+	log.Printf("Quarantined corrupt blob (%s): %v\n", hash, reason)
+}
+
+// loadBody reads and verifies the body of entry, stored under key
+// Corrupt or missing bodies are quarantined and reported as an error
+func (c *HTTPCache) loadBody(key string, entry *CacheEntry) ([]byte, error) {
+	body := entry.Body
+	if entry.BodyHash != "" {
+		var err error
+		if body, err = c.blobs.get(entry.BodyHash); err != nil {
+			c.quarantine(key, err)
+			return nil, err
+		}
+	}
+	if err := verifyEntry(entry, body); err != nil {
+		if entry.BodyHash != "" && blobHash(body) != entry.BodyHash {
+			c.blobs.quarantine(entry.BodyHash, err)
+		}
+		c.quarantine(key, err)
+		return nil, err
+	}
+	return body, nil
+}
+
+// Scrub validates the whole store: every blob must match its hash, and every
+// metadata record must decode and have an intact body. Anything corrupt is
+// quarantined, so the affected URLs are refetched on their next request
+func (c *HTTPCache) Scrub() scrubReport {
+	var report scrubReport
+
+	if files, err := os.ReadDir(c.blobs.dir); err == nil {
+		for _, f := range files {
+			hash := f.Name()
+			if strings.HasPrefix(hash, "tmp-") {
+				continue
+			}
+			data, err := c.blobs.get(hash)
+			if err != nil {
+				continue
+			}
+			report.Blobs++
+			if blobHash(data) != hash {
+				c.blobs.quarantine(hash, fmt.Errorf("content does not match its hash"))
+				report.Quarantined++
+			}
+		}
+	}
+
+	files, err := os.ReadDir(c.cacheDir)
+	if err != nil {
+		log.Printf("Error reading cache directory: %v", err)
+		return report
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		key := f.Name()
+		report.Entries++
+		entry, err := c.readEntry(key)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				c.quarantine(key, err)
+				report.Quarantined++
+			}
+			continue
+		}
+		if _, err := c.loadBody(key, entry); err != nil {
+			report.Quarantined++
+		}
+	}
+
+	log.Printf("Cache scrub checked %d entries and %d blobs, quarantined %d\n",
+		report.Entries, report.Blobs, report.Quarantined)
+	return report
+}
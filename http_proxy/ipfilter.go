@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// netRule is a rule matching IP addresses in a range
+type netRule struct {
+	ipNet *net.IPNet
+	rule  *blockRule
+}
+
+// parseIPRule parses an IP address or CIDR range, IPv4 or IPv6, into the
+// range it covers. It returns nil for anything else
+func parseIPRule(text string) *net.IPNet {
+	if _, ipNet, err := net.ParseCIDR(text); err == nil {
+		return ipNet
+	}
+	ip := net.ParseIP(text)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// matchIP returns the first range rule of the index containing ip and
+// applying to q, or nil
+func (ri *ruleIndex) matchIP(ip net.IP, q *ruleQuery) *blockRule {
+	for _, n := range ri.nets {
+		if n.ipNet.Contains(ip) && n.rule.applies(q) {
+			return n.rule
+		}
+	}
+	return nil
+}
+
+// MatchIP decides whether connecting to ip is blocked for clients in group
+// by an address or range rule, and returns the rule that decided it. It is
+// applied to every address a host name resolves to, so a blocked address
+// cannot be reached through another name. Unlike host names, addresses no
+// rule matches are always allowed, since default-deny mode already applied
+// to the name
+func (bs *BlockedSet) MatchIP(ip net.IP, group *clientGroup) (bool, *blockRule) {
+	q := &ruleQuery{host: ip.String(), now: bs.clock()}
+	lists := bs.listsFor(group)
+	for _, rules := range lists {
+		if rule := rules.allow.matchIP(ip, q); rule != nil {
+			return false, rule
+		}
+	}
+	for _, rules := range lists {
+		if rule := rules.block.matchIP(ip, q); rule != nil {
+			return true, rule
+		}
+	}
+	return false, nil
+}
+
+// blockedAddrError is returned instead of dialing a host that resolved to a
+// blocked address
+type blockedAddrError struct {
+	host string
+	ip   net.IP
+	rule *blockRule
+}
+
+func (e *blockedAddrError) Error() string {
+	return fmt.Sprintf("%s resolves to blocked address %s", e.host, e.ip)
+}
+
+// dialer returns a dial function for connections made on behalf of clients
+// in group. It resolves the host itself and refuses to connect if any of
+// its addresses is blocked, which also keeps clients from reaching private
+// ranges through the proxy (SSRF) when those are blocked. It then dials the
+// checked addresses rather than the name, so a second DNS lookup cannot
+// return a different address
+func (p *forwardProxy) dialer(group *clientGroup) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			if blocked, rule := p.blockedSet.MatchIP(a.IP, group); blocked {
+				return nil, &blockedAddrError{host: host, ip: a.IP, rule: rule}
+			}
+		}
+
+		var lastErr error
+		for _, a := range addrs {
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+}
+
+// transport returns the transport for requests made on behalf of clients
+// in group. Each group gets its own, so that an idle connection dialed
+// after checking one group's address rules is never reused for another
+func (p *forwardProxy) transport(group *clientGroup) *http.Transport {
+	p.transportsMu.Lock()
+	defer p.transportsMu.Unlock()
+
+	if t, ok := p.transports[group]; ok {
+		return t
+	}
+	if p.transports == nil {
+		p.transports = make(map[*clientGroup]*http.Transport)
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = p.dialer(group)
+	p.transports[group] = t
+	return t
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// negativeCache remembers failures so they are not retried on every request
+// Error responses with one of the configured status codes (404 and 410 by
+// default) are stored in the HTTP cache for statusTTL when they carry no
+// Cache-Control header at all. DNS and connection failures are kept in
+// memory per host for errorTTL, during which requests to that host fail
+// immediately instead of waiting for another lookup or connect timeout,
+// unless a cached copy of the URL, even a stale one, can be served
+type negativeCache struct {
+	mu        sync.Mutex
+	statuses  map[int]bool
+	statusTTL time.Duration
+	errorTTL  time.Duration
+	failures  map[string]hostFailure // Keyed by host:port
+}
+
+// hostFailure is a remembered DNS or connection failure for one host
+type hostFailure struct {
+	err   string
+	until time.Time
+}
+
+// negativeHitError is returned instead of contacting a host that failed
+// recently
+type negativeHitError struct {
+	host string
+	err  string
+}
+
+func (e *negativeHitError) Error() string {
+	return fmt.Sprintf("%s failed recently: %s", e.host, e.err)
+}
+
+// newNegativeCache creates a negativeCache for the given comma-separated
+// status codes. A TTL of 0 disables the corresponding kind of caching
+func newNegativeCache(statuses string, statusTTL, errorTTL time.Duration) (*negativeCache, error) {
+	n := &negativeCache{
+		statuses:  make(map[int]bool),
+		statusTTL: statusTTL,
+		errorTTL:  errorTTL,
+		failures:  make(map[string]hostFailure),
+	}
+	for _, s := range strings.Split(statuses, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		code, err := strconv.Atoi(s)
+		if err != nil || code < 400 || code > 599 {
+			return nil, fmt.Errorf("invalid negative caching status %q", s)
+		}
+		n.statuses[code] = true
+	}
+	return n, nil
+}
+
+// statusMaxAge returns the max-age in seconds to cache a response with the
+// given status code and headers for, and false if it is not negatively
+// cached. A response whose Cache-Control says anything, even that it must
+// not be stored, is left to its headers. The TTL is rounded up to whole
+// seconds, so one under a second does not become a max-age of 0
+func (n *negativeCache) statusMaxAge(status int, header http.Header) (int64, bool) {
+	if n.statusTTL <= 0 || !n.statuses[status] || header.Get("Cache-Control") != "" {
+		return 0, false
+	}
+	return int64((n.statusTTL + time.Second - 1) / time.Second), true
+}
+
+// hostKey normalizes host, as found in a request URL or a CONNECT request,
+// to the lower-cased host:port that failures are remembered by, adding
+// defaultPort when it has none
+func hostKey(host, defaultPort string) string {
+	host = strings.ToLower(host)
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+}
+
+// urlHostKey is the hostKey of the host a request URL points at
+func urlHostKey(req *http.Request) string {
+	if req.URL.Scheme == "https" {
+		return hostKey(req.URL.Host, "443")
+	}
+	return hostKey(req.URL.Host, "80")
+}
+
+// check returns a negativeHitError if host failed within the last errorTTL
+func (n *negativeCache) check(host string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, ok := n.failures[host]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(f.until) {
+		delete(n.failures, host)
+		return nil
+	}
+	return &negativeHitError{host: host, err: f.err}
+}
+
+// recordFailure remembers that reaching host failed with err
+func (n *negativeCache) recordFailure(host string, err error) {
+	if n.errorTTL <= 0 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Drop expired failures now and then so the map stays small
+	if len(n.failures) > 1000 {
+		now := time.Now()
+		for h, f := range n.failures {
+			if now.After(f.until) {
+				delete(n.failures, h)
+			}
+		}
+	}
+	n.failures[host] = hostFailure{err: err.Error(), until: time.Now().Add(n.errorTTL)}
+	log.Printf("Caching failure of %s for %v\n", host, n.errorTTL)
+}
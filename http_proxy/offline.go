@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// offlineMode tracks whether the proxy should stop contacting origin servers
+// and answer from the cache alone
+// It is switched on manually (the -offline flag or the /offline admin
+// endpoint) or automatically after threshold consecutive dial failures with
+// no successful fetch in between, against at least minHosts different
+// hosts, so one dead origin is not mistaken for the network being down
+// While automatically offline, one request
+// per retry interval is still let through to the origin, and the first one
+// that succeeds brings the proxy back online
+type offlineMode struct {
+	mu        sync.Mutex
+	manual    bool            // Offline because an operator asked for it
+	auto      bool            // Offline because the origins became unreachable
+	failures  int             // Consecutive dial failures seen so far
+	hosts     map[string]bool // Hosts those failures were against
+	threshold int             // Dial failures that switch to automatic offline mode
+	minHosts  int             // Different hosts that must have failed as well
+	retry     time.Duration   // Interval between attempts to reach an origin while offline
+	lastTry   time.Time       // Time of the last attempt to reach an origin
+}
+
+// newOfflineMode creates an offlineMode that goes offline after threshold
+// consecutive dial failures against at least minHosts hosts, and retries
+// the origin every retry interval. A threshold of 0 disables the automatic
+// switch
+func newOfflineMode(threshold, minHosts int, retry time.Duration) *offlineMode {
+	return &offlineMode{threshold: threshold, minHosts: minHosts, retry: retry, hosts: make(map[string]bool)}
+}
+
+// Offline reports whether the proxy is currently in offline mode
+func (o *offlineMode) Offline() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.manual || o.auto
+}
+
+// SetManual switches the manual offline toggle on or off
+func (o *offlineMode) SetManual(offline bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.manual = offline
+	log.Printf("Offline mode manually set to %v\n", offline)
+}
+
+// shouldTryOrigin reports whether a request should be sent to the origin
+// It is always true while online. While automatically offline it is true
+// for one request per retry interval, so the proxy notices when the origin
+// is reachable again. It is never true while manually offline
+func (o *offlineMode) shouldTryOrigin() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.manual {
+		return false
+	}
+	if !o.auto {
+		return true
+	}
+	if time.Since(o.lastTry) < o.retry {
+		return false
+	}
+	o.lastTry = time.Now()
+	return true
+}
+
+// recordSuccess notes that an origin answered, leaving automatic offline mode
+func (o *offlineMode) recordSuccess() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.failures = 0
+	o.hosts = make(map[string]bool)
+	if o.auto {
+		o.auto = false
+		log.Println("Origin reachable again, leaving offline mode")
+	}
+}
+
+// recordFailure notes that dialing host failed, entering automatic offline
+// mode once threshold failures against minHosts hosts happened in a row
+func (o *offlineMode) recordFailure(host string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.failures++
+	o.hosts[host] = true
+	o.lastTry = time.Now()
+	if !o.auto && o.threshold > 0 && o.failures >= o.threshold && len(o.hosts) >= o.minHosts {
+		o.auto = true
+		log.Printf("%d consecutive dial failures against %d hosts, entering offline mode\n", o.failures, len(o.hosts))
+	}
+}
+
+// isDialError reports whether err means the origin could not be reached at
+// all (DNS lookup or TCP connect failed), as opposed to an error that
+// happened after a connection was established
+func isDialError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isOutageError reports whether err suggests the network or the origins are
+// down, as opposed to a dial error caused by the request itself: a host
+// name that does not exist (NXDOMAIN), typically a typo, says nothing about
+// whether other origins can be reached
+func isOutageError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false
+	}
+	return isDialError(err)
+}
+
+// serveOffline answers req from the cache while the origin is unreachable
+// Any cached entry is served regardless of freshness and marked with a
+// Warning and a Cache-Status header; URLs that are not cached get a 504
+func (p *forwardProxy) serveOffline(w http.ResponseWriter, req *http.Request, user, groupName string) {
+	if p.serveStale(w, req, user, groupName, `112 - "Disconnected Operation"`, "detail=offline") {
+		log.Println("Served from cache while offline")
+		return
+	}
+
+	setCacheStatus(w.Header(), "fwd=miss", "detail=offline")
+	msg := "Gateway Timeout: the origin server is unreachable and " + req.URL.String() + " is not cached"
+	http.Error(w, msg, http.StatusGatewayTimeout)
+	log.Println(msg)
+}
+
+// serveStale answers a GET from the cache when the origin cannot be reached,
+// whether or not the cached entry is fresh, and reports whether it did. The
+// response carries warning, Warning 110 as well when it is stale, and a
+// Cache-Status hit with detail. The request has already been counted as a
+// miss, which a cached entry turns into a hit
+func (p *forwardProxy) serveStale(w http.ResponseWriter, req *http.Request, user, groupName, warning, detail string) bool {
+	if req.Method != "GET" {
+		return false
+	}
+	cachedResponse, stale, found := p.cache.GetStale(p.policies.match(req.URL).keyRequest(req))
+	if !found {
+		return false
+	}
+	if rule, _ := p.filters.apply(req, cachedResponse); rule != nil {
+		cachedResponse.Body.Close()
+		p.serveBlocked(w, req, rule, user, groupName)
+		return true
+	}
+	removeHopHeaders(cachedResponse.Header)
+	removeConnectionHeaders(cachedResponse.Header)
+	copyHeader(w.Header(), cachedResponse.Header)
+	if stale {
+		w.Header().Add("Warning", `110 - "Response is Stale"`)
+	}
+	w.Header().Add("Warning", warning)
+	setCacheStatus(w.Header(), "hit", detail)
+	w.WriteHeader(cachedResponse.StatusCode)
+	n := p.copyFiltered(w, req, cachedResponse.Body, user, groupName)
+	p.cache.stats.recordMissServed(req.URL.Hostname(), n, stale)
+	return true
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// peerReplicas is the number of points each member gets on the hash ring,
+// which spreads keys evenly across a small number of instances
+const peerReplicas = 100
+
+// peerProbeURL is what health probes ask peers for. It is never cached, so
+// a working peer answers the only-if-cached probe with a 504
+const peerProbeURL = "http://peer-probe.invalid/"
+
+// errPeerAuth is the failure recorded for a peer that asks for proxy
+// credentials, which peers do not send: it is running with -users
+var errPeerAuth = errors.New("peer requires proxy authentication (407); sibling proxies must run without -users")
+
+// peer is another instance of this proxy that may hold a cached copy of a URL
+type peer struct {
+	url    string
+	client *http.Client
+
+	mu       sync.Mutex
+	healthy  bool
+	failures int       // Consecutive failed queries or probes
+	lastErr  string    // Most recent failure
+	lastSeen time.Time // Time of the last successful query or probe
+}
+
+// peerStatus is the health of one peer as reported by the /peers endpoint
+type peerStatus struct {
+	URL      string    `json:"url"`
+	Healthy  bool      `json:"healthy"`
+	Failures int       `json:"failures"`
+	LastErr  string    `json:"last_error,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// ringPoint is one point of the consistent hash ring
+type ringPoint struct {
+	hash   uint32
+	member string
+}
+
+// peerSet lets sibling proxies share their caches
+// Every member, this instance included, owns the cache keys that hash to its
+// stretch of a consistent hash ring. On a local miss the proxy asks only the
+// owning peer, with "Cache-Control: only-if-cached" so the peer answers from
+// its cache or with a 504 and never goes to the origin on our behalf. Keys
+// owned by an unhealthy peer move to the next healthy member on the ring
+type peerSet struct {
+	self  string
+	peers map[string]*peer
+	ring  []ringPoint
+}
+
+// newPeerSet creates a peerSet for this instance, reachable at self, and the
+// given peer proxy URLs. Queries to a peer time out after timeout
+func newPeerSet(self string, peerURLs []string, timeout time.Duration) (*peerSet, error) {
+	ps := &peerSet{self: self, peers: make(map[string]*peer)}
+	members := []string{self}
+	for _, raw := range peerURLs {
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme != "http" || u.Host == "" {
+			return nil, fmt.Errorf("invalid peer URL %q", raw)
+		}
+		if raw == self {
+			continue
+		}
+		ps.peers[raw] = &peer{
+			url:     raw,
+			healthy: true,
+			client: &http.Client{
+				Transport: &http.Transport{Proxy: http.ProxyURL(u)},
+				Timeout:   timeout,
+				// Redirects are the client's business, not ours
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			},
+		}
+		members = append(members, raw)
+	}
+
+	for _, m := range members {
+		for i := 0; i < peerReplicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(m + "#" + strconv.Itoa(i)))
+			ps.ring = append(ps.ring, ringPoint{hash: h, member: m})
+		}
+	}
+	sort.Slice(ps.ring, func(i, j int) bool { return ps.ring[i].hash < ps.ring[j].hash })
+	return ps, nil
+}
+
+// owner returns the healthy peer that owns key, or nil when this instance
+// owns it (or no peer is healthy)
+func (ps *peerSet) owner(key string) *peer {
+	if len(ps.peers) == 0 {
+		return nil
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(ps.ring), func(i int) bool { return ps.ring[i].hash >= h })
+
+	// Walk clockwise past unhealthy peers
+	for i := 0; i < len(ps.ring); i++ {
+		member := ps.ring[(start+i)%len(ps.ring)].member
+		if member == ps.self {
+			return nil
+		}
+		if p := ps.peers[member]; p.isHealthy() {
+			return p
+		}
+	}
+	return nil
+}
+
+// lookup asks the peer owning key for a cached copy of req's URL
+// It returns the peer's response when it had one, and the peer asked. Only
+// a 2xx response whose Cache-Status says the peer served it from its cache
+// counts; anything else, such as a 504, an error page or a cached 404, is a
+// miss and the request goes to the origin
+func (ps *peerSet) lookup(req *http.Request, key string) (*http.Response, *peer, bool) {
+	p := ps.owner(key)
+	if p == nil {
+		return nil, nil, false
+	}
+
+	peerReq, err := http.NewRequest("GET", req.URL.String(), nil)
+	if err != nil {
+		return nil, p, false
+	}
+	copyHeader(peerReq.Header, req.Header)
+	removeHopHeaders(peerReq.Header)
+	removeConnectionHeaders(peerReq.Header)
+	peerReq.Header.Set("Cache-Control", "only-if-cached")
+
+	resp, err := p.client.Do(peerReq)
+	if err != nil {
+		p.recordFailure(err)
+		return nil, p, false
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		resp.Body.Close()
+		p.recordFailure(errPeerAuth)
+		return nil, p, false
+	}
+	p.recordSuccess()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || !isCacheHit(resp.Header) {
+		resp.Body.Close()
+		return nil, p, false
+	}
+	return resp, p, true
+}
+
+// isCacheHit reports whether header has a Cache-Status entry from a proxy
+// like this one with the hit parameter
+func isCacheHit(header http.Header) bool {
+	for _, value := range header.Values("Cache-Status") {
+		for _, entry := range strings.Split(value, ",") {
+			params := strings.Split(entry, ";")
+			if strings.TrimSpace(params[0]) != cacheStatusName {
+				continue
+			}
+			for _, param := range params[1:] {
+				if strings.TrimSpace(param) == "hit" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// checkHealth probes every peer each interval, so unhealthy peers rejoin
+// once they answer again
+func (ps *peerSet) checkHealth(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, p := range ps.peers {
+			p.probe()
+		}
+	}
+}
+
+// probe asks the peer for peerProbeURL the way lookup asks for cached
+// copies, so a peer that is reachable but refuses our queries, such as one
+// asking for proxy credentials, stays unhealthy
+func (p *peer) probe() {
+	req, _ := http.NewRequest("GET", peerProbeURL, nil)
+	req.Header.Set("Cache-Control", "only-if-cached")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.recordFailure(err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		p.recordFailure(errPeerAuth)
+		return
+	}
+	p.recordSuccess()
+}
+
+// Status reports the health of every peer
+func (ps *peerSet) Status() []peerStatus {
+	var statuses []peerStatus
+	for _, p := range ps.peers {
+		p.mu.Lock()
+		statuses = append(statuses, peerStatus{
+			URL:      p.url,
+			Healthy:  p.healthy,
+			Failures: p.failures,
+			LastErr:  p.lastErr,
+			LastSeen: p.lastSeen,
+		})
+		p.mu.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].URL < statuses[j].URL })
+	return statuses
+}
+
+func (p *peer) isHealthy() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.healthy
+}
+
+// recordFailure marks the peer unhealthy until a later query or probe succeeds
+func (p *peer) recordFailure(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.healthy {
+		log.Printf("Peer %s is down: %v\n", p.url, err)
+	}
+	p.healthy = false
+	p.failures++
+	p.lastErr = err.Error()
+}
+
+// recordSuccess marks the peer healthy
+func (p *peer) recordSuccess() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.healthy {
+		log.Printf("Peer %s is back up\n", p.url)
+	}
+	p.healthy = true
+	p.failures = 0
+	p.lastSeen = time.Now()
+}
+
+// splitPeers turns the comma-separated -peers flag into a list of URLs
+func splitPeers(list string) []string {
+	var urls []string
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, strings.TrimSuffix(u, "/"))
+		}
+	}
+	return urls
+}
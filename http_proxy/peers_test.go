@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ownerOf returns the URL of the member owning key, this instance included
+func ownerOf(ps *peerSet, key string) string {
+	if p := ps.owner(key); p != nil {
+		return p.url
+	}
+	return ps.self
+}
+
+func TestPeerRingSpreadsAndMovesFewKeys(t *testing.T) {
+	members := []string{"http://10.0.0.1:9999", "http://10.0.0.2:9999", "http://10.0.0.3:9999"}
+	ps, err := newPeerSet(members[0], members, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const keys = 3000
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owners[key] = ownerOf(ps, key)
+		counts[owners[key]]++
+	}
+	for _, m := range members {
+		if counts[m] < keys/6 {
+			t.Errorf("%s owns %d of %d keys, want about a third", m, counts[m], keys)
+		}
+	}
+
+	// The same members always pick the same owner
+	again, _ := newPeerSet(members[0], members, time.Second)
+	for key, owner := range owners {
+		if got := ownerOf(again, key); got != owner {
+			t.Fatalf("%s is owned by %s, then by %s", key, owner, got)
+		}
+	}
+
+	// Only the keys of an unhealthy peer move, and never to it
+	down := ps.peers[members[2]]
+	down.recordFailure(fmt.Errorf("connection refused"))
+	for key, owner := range owners {
+		got := ownerOf(ps, key)
+		if owner != members[2] && got != owner {
+			t.Errorf("%s moved from %s to %s though its owner is healthy", key, owner, got)
+		}
+		if got == members[2] {
+			t.Errorf("%s is still owned by the unhealthy peer", key)
+		}
+	}
+	down.recordSuccess()
+	for key, owner := range owners {
+		if got := ownerOf(ps, key); got != owner {
+			t.Fatalf("%s is owned by %s after the peer came back, want %s", key, got, owner)
+		}
+	}
+}
+
+// newTestPeer starts a peer proxy answering every query with status, and
+// returns a peerSet in which it owns every key
+func newTestPeer(t *testing.T, status *int32) (*peerSet, *peer) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(status)))
+	}))
+	t.Cleanup(server.Close)
+	ps, err := newPeerSet("http://127.0.0.1:1", []string{server.URL}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leave only the peer on the ring
+	var ring []ringPoint
+	for _, point := range ps.ring {
+		if point.member == server.URL {
+			ring = append(ring, point)
+		}
+	}
+	ps.ring = ring
+	return ps, ps.peers[server.URL]
+}
+
+func TestPeerAskingForCredentialsIsUnhealthy(t *testing.T) {
+	status := int32(http.StatusProxyAuthRequired)
+	ps, p := newTestPeer(t, &status)
+	req := mustRequest(t, "http://a.example/")
+
+	if _, asked, found := ps.lookup(req, "key"); found || asked != p {
+		t.Fatalf("lookup found %v from %v, want a miss asking the peer", found, asked)
+	}
+	if p.isHealthy() {
+		t.Fatal("peer answering 407 is healthy")
+	}
+	if st := ps.Status(); len(st) != 1 || st[0].Healthy || st[0].LastErr != errPeerAuth.Error() {
+		t.Fatalf("/peers reports %+v, want the peer unhealthy with %q", st, errPeerAuth)
+	}
+	if _, asked, _ := ps.lookup(req, "key"); asked != nil {
+		t.Fatal("unhealthy peer was asked again")
+	}
+
+	// Probes keep it out while it asks for credentials
+	p.probe()
+	if p.isHealthy() {
+		t.Fatal("probe marked a peer answering 407 healthy")
+	}
+
+	// and let it back in once it answers
+	atomic.StoreInt32(&status, http.StatusGatewayTimeout)
+	p.probe()
+	if !p.isHealthy() {
+		t.Fatal("probe left a working peer unhealthy")
+	}
+	if st := ps.Status(); st[0].Failures != 0 {
+		t.Errorf("/peers reports %d failures after recovery, want 0", st[0].Failures)
+	}
+}
+
+func TestUnreachablePeerIsUnhealthy(t *testing.T) {
+	status := int32(http.StatusGatewayTimeout)
+	ps, p := newTestPeer(t, &status)
+	p.client.Transport.(*http.Transport).Proxy = http.ProxyURL(mustRequest(t, "http://127.0.0.1:1").URL)
+
+	if _, _, found := ps.lookup(mustRequest(t, "http://a.example/"), "key"); found {
+		t.Fatal("lookup found a copy on an unreachable peer")
+	}
+	if p.isHealthy() {
+		t.Fatal("unreachable peer is healthy")
+	}
+	p.probe()
+	if st := ps.Status(); st[0].Healthy || st[0].Failures != 2 || st[0].LastErr == "" {
+		t.Errorf("/peers reports %+v, want the peer unhealthy after 2 failures", st[0])
+	}
+}
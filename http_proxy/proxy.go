@@ -1,4 +1,4 @@
-// To start the server application, run "go run cache_without_lru.go blockedset.go proxy.go"
+// To start the server application, run "go run ." in this directory
 // If you test locally, make sure client.go is running too on a separate terminal
 // If you test with Firefox, make sure you have the right IP addresses set
 // See detailed instructions on how to run the proxy server here:
@@ -20,15 +20,22 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -82,11 +89,34 @@ func appendHostToXForwardHeader(header http.Header, host string) {
 	header.Set("X-Forwarded-For", host)
 }
 
+// cacheStatusName identifies this proxy in Cache-Status response headers
+const cacheStatusName = "forward-proxy"
+
+// setCacheStatus adds this proxy's entry to the Cache-Status header (RFC 9211)
+// e.g. setCacheStatus(h, "fwd=miss", "stored") adds "forward-proxy; fwd=miss; stored"
+func setCacheStatus(header http.Header, params ...string) {
+	header.Add("Cache-Status", strings.Join(append([]string{cacheStatusName}, params...), "; "))
+}
+
 // forwardProxy defines the structure of a forward proxy server, which includes
 // functionality for blocking certain domains and caching HTTP responses
 type forwardProxy struct {
 	blockedSet *BlockedSet
+	groups     *clientGroups
+	users      *proxyUsers // nil when proxy authentication is disabled
+	blockPage  *blockPage
+	filters    *responseFilters
+	audit      *auditLog
+	safeSearch *safeSearch
 	cache      *HTTPCache
+	offline    *offlineMode
+	policies   *cachePolicies
+	negative   *negativeCache
+	peers      *peerSet
+	admin      http.Handler
+
+	transportsMu sync.Mutex
+	transports   map[*clientGroup]*http.Transport // See transport
 }
 
 // ServeHTTP handles incoming HTTP requests by forwarding them to the destination server,
@@ -98,18 +128,38 @@ func (p *forwardProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	log.Println(req.RemoteAddr, "\t\t", req.Method, "\t\t", req.URL, "\t\t Host:", req.Host)
 	log.Println("Initial Headers:", req.Header)
 
-	// Check for blocked domain
-	if p.blockedSet.IsBlocked(req.URL.Hostname()) {
-		http.Error(w, "Forbidden Content", http.StatusForbidden)
-		log.Println("Forbidden Content")
+	// Requests addressed to the proxy itself rather than to an origin
+	// are handled by the admin endpoints
+	if req.Method != "CONNECT" && !req.URL.IsAbs() {
+		p.admin.ServeHTTP(w, req)
+		return
+	}
+
+	user, ok := p.authenticate(w, req)
+	if !ok {
+		return
+	}
+
+	// Check for blocked hosts and requests, with the lists of the client's group
+	group := p.groups.match(net.ParseIP(extractClientIP(req)), user)
+	groupName := "default"
+	if group != nil {
+		groupName = group.name
+	}
+	blocked, rule := p.blockedSet.MatchRequest(req, group)
+	if blocked {
+		p.serveBlocked(w, req, rule, user, groupName)
 		return
 	}
+	if rule != nil {
+		log.Println("Allowed by rule", rule, "for group", groupName)
+	}
 
 	// Note to Grader: If you wish to configure the server to only handle HTTP
 	// but not HTTPS requests, move the following code block to the indicated
 	// position below (after validating for http requests)
 	if req.Method == "CONNECT" {
-		p.handleTunneling(w, req)
+		p.handleTunneling(w, req, user, group, groupName)
 		return
 	}
 
@@ -123,24 +173,75 @@ func (p *forwardProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	// Note to Grader: You may move CONNECT checks here
 
+	// Force safe search on search and video sites before the cache is
+	// consulted, so the rewritten request is the one cached
+	p.safeSearch.rewrite(req)
+
+	// Cache policy overrides configured for this URL, if any
+	policy := p.policies.match(req.URL)
+
 	// Only GET requests are getting cached
 	if req.Method == "GET" {
 		// If the data is cached and not stale, get it from the cache
-		if cachedResponse, found := p.cache.Get(req); found {
+		if cachedResponse, found := p.cache.Get(policy.keyRequest(req)); found {
+			// The response filters may have changed since it was cached
+			if rule, _ := p.filters.apply(req, cachedResponse); rule != nil {
+				cachedResponse.Body.Close()
+				p.serveBlocked(w, req, rule, user, groupName)
+				return
+			}
 			processStartTime := time.Now()
 			// Copy cached response to the response writer
 			removeHopHeaders(cachedResponse.Header)
 			removeConnectionHeaders(cachedResponse.Header)
 			log.Println("cached header", cachedResponse.Header)
 			copyHeader(w.Header(), cachedResponse.Header)
+			setCacheStatus(w.Header(), policy.cacheStatusParams("hit")...)
 			w.WriteHeader(cachedResponse.StatusCode)
-			io.Copy(w, cachedResponse.Body)
+			n := p.copyFiltered(w, req, cachedResponse.Body, user, groupName)
+			p.cache.stats.recordHit(req.URL.Hostname(), n, false)
 			processDuration := time.Since(processStartTime)
 			log.Printf("Served from cache in %v\n", processDuration)
 			// log.Println("Served from cache")
 			return
 		}
+		p.cache.stats.recordMiss(req.URL.Hostname())
+
+		// A client asking for only-if-cached, such as a sibling proxy,
+		// gets a 504 rather than a fetch from the origin
+		if strings.Contains(req.Header.Get("Cache-Control"), "only-if-cached") {
+			setCacheStatus(w.Header(), policy.cacheStatusParams("fwd=miss")...)
+			http.Error(w, "Gateway Timeout: "+req.URL.String()+" is not cached", http.StatusGatewayTimeout)
+			return
+		}
+
+		// Before going to the origin, ask the sibling proxy owning this URL
+		key := p.cache.CacheKey(policy.keyRequest(req))
+		if peerResponse, peer, found := p.peers.lookup(req, key); found {
+			defer peerResponse.Body.Close()
+			if rule, _ := p.filters.apply(req, peerResponse); rule != nil {
+				p.serveBlocked(w, req, rule, user, groupName)
+				return
+			}
+			removeHopHeaders(peerResponse.Header)
+			removeConnectionHeaders(peerResponse.Header)
+			copyHeader(w.Header(), peerResponse.Header)
+			setCacheStatus(w.Header(), "fwd=miss", "detail="+strconv.Quote("peer "+peer.url))
+			w.WriteHeader(peerResponse.StatusCode)
+			n := p.copyFiltered(w, req, peerResponse.Body, user, groupName)
+			p.cache.stats.recordPeerHit(req.URL.Hostname(), n)
+			log.Printf("Served from peer %s\n", peer.url)
+			return
+		}
 	}
+
+	// While offline, answer from the cache alone unless it is time to
+	// check whether the origin is reachable again
+	if !p.offline.shouldTryOrigin() {
+		p.serveOffline(w, req, user, groupName)
+		return
+	}
+
 	processStartTime := time.Now()
 	// Add the X-Forwarded-Proto header
 	req.Header.Set("X-Forwarded-Proto", "http")
@@ -150,93 +251,207 @@ func (p *forwardProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	removeHopHeaders(req.Header)
 	removeConnectionHeaders(req.Header)
 	log.Println("Modified Headers:", req.Header) // Check the modified headers
-	client := &http.Client{}
-	req.RequestURI = ""
-	resp, err := client.Do(req)
+	resp, stored, err := p.fetch(req, group)
 	if err != nil {
-		http.Error(w, "Server Error", http.StatusInternalServerError)
-		log.Fatal("ServeHTTP:", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Helps with making sure the resp.Body is not read before sending it to the client while caching it
-	var box bytes.Buffer
-	// Tracks if the data was cachable and the cache.put function is called
-	cachable := -1
-	if req.Method == "GET" {
-		cacheControl := resp.Header.Get("Cache-Control")
-		var maxAge int64
-		maxAge = -1
-		// Default value if max-age is not specified
-		lastModified := "na"
-		// Check if the response is cacheable
-		if strings.Contains(cacheControl, "public") || strings.Contains(cacheControl, "no-cache") ||
-			strings.Contains(cacheControl, "max-age") {
-			// Parse max-age if present
-			if strings.Contains(cacheControl, "max-age") {
-				maxAgeDirectives := strings.Split(cacheControl, ",")
-				for _, directive := range maxAgeDirectives {
-					if strings.Contains(directive, "max-age") {
-						maxAgeValue := strings.Split(directive, "=")
-						if len(maxAgeValue) == 2 {
-							maxAgeParsed, err := strconv.Atoi(strings.TrimSpace(maxAgeValue[1]))
-							if err == nil {
-								maxAge = int64(maxAgeParsed)
-							}
-							break
-						}
-					}
-				}
-			}
-
-			lastModified = resp.Header.Get("Last-Modified")
-			// log.Println("LAST MODIFIED", lastModified)
-			// If we do not know when was the web page last-modified, we take a coservative approach by treating it as a stale page
-			if lastModified == "" {
-				lastModified = "na"
+		log.Println("ServeHTTP:", err)
+		// The host resolved to a blocked address
+		var blockedAddr *blockedAddrError
+		if errors.As(err, &blockedAddr) {
+			p.serveBlocked(w, req, blockedAddr.rule, user, groupName)
+			return
+		}
+		// The response filters rejected what the origin sent
+		var blockedResponse *blockedResponseError
+		if errors.As(err, &blockedResponse) {
+			p.serveBlocked(w, req, blockedResponse.rule, user, groupName)
+			return
+		}
+		// The host failed moments ago and was not contacted again. A
+		// cached copy, even a stale one, beats an error
+		var negativeHit *negativeHitError
+		if errors.As(err, &negativeHit) {
+			if p.serveStale(w, req, user, groupName, `111 - "Revalidation Failed"`, `detail="negative"`) {
+				log.Println("Served from cache as", negativeHit.host, "failed recently")
+				return
 			}
-
-			// Store in cache based on max-age
-			if maxAge != -1 {
-				box = p.cache.Put(req, resp, maxAge, lastModified)
-				cachable = 0
-
-			} else {
-				box = p.cache.Put(req, resp, -1, lastModified) // Store without max-age, i.e. always validate the data
-				cachable = 0
+			setCacheStatus(w.Header(), "fwd=miss", `detail="negative"`)
+			http.Error(w, "Bad Gateway: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		// Repeated dial failures switch the proxy to offline mode, in
+		// which cached entries are served regardless of freshness
+		if isOutageError(err) {
+			p.offline.recordFailure(urlHostKey(req))
+			if p.offline.Offline() {
+				p.serveOffline(w, req, user, groupName)
+				return
 			}
-		} else {
-			log.Println("Not cacheable")
 		}
+		// Until then a host that cannot be reached is answered like one
+		// remembered in the negative cache
+		if isDialError(err) && p.serveStale(w, req, user, groupName, `111 - "Revalidation Failed"`, `detail="unreachable"`) {
+			log.Println("Served from cache as", req.URL.Host, "is unreachable")
+			return
+		}
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
 	}
+	defer resp.Body.Close()
+	p.offline.recordSuccess()
+
 	log.Println(req.RemoteAddr, " ", resp.Status)
 	removeHopHeaders(resp.Header)
 	removeConnectionHeaders(resp.Header)
 	copyHeader(w.Header(), resp.Header)
-	w.WriteHeader(resp.StatusCode)
-	// Return the resp.Body based on whether it was cached
-	if cachable == 0 {
-		io.Copy(w, bytes.NewReader(box.Bytes()))
+	if stored {
+		setCacheStatus(w.Header(), policy.cacheStatusParams("fwd=miss", "stored")...)
 	} else {
-		io.Copy(w, resp.Body)
+		setCacheStatus(w.Header(), policy.cacheStatusParams("fwd=miss")...)
 	}
+	w.WriteHeader(resp.StatusCode)
+	n := p.copyFiltered(w, req, resp.Body, user, groupName)
+	p.cache.stats.recordOrigin(req.URL.Hostname(), n, resp.StatusCode)
 	processDuration := time.Since(processStartTime)
 	log.Printf("Served from destination server in %v\n", processDuration)
 	totalDuration := time.Since(startTime)
 	log.Printf("Total request processing time: %v\n", totalDuration)
 }
 
+// parseCacheHeaders decides from the response headers whether a response is
+// cacheable, its max-age in seconds (-1 if it must be refetched on every use)
+// and when it was last modified ("na" if unknown)
+func parseCacheHeaders(header http.Header) (bool, int64, string) {
+	cacheControl := header.Get("Cache-Control")
+	// Check if the response is cacheable
+	if !strings.Contains(cacheControl, "public") && !strings.Contains(cacheControl, "no-cache") &&
+		!strings.Contains(cacheControl, "max-age") {
+		return false, -1, "na"
+	}
+
+	// Default value if max-age is not specified. A no-cache response is
+	// kept for its max-age too, if it has one
+	var maxAge int64 = -1
+	if age, ok := parseMaxAge(cacheControl); ok {
+		maxAge = age
+	}
+
+	lastModified := header.Get("Last-Modified")
+	// If we do not know when was the web page last-modified, we take a coservative approach by treating it as a stale page
+	if lastModified == "" {
+		lastModified = "na"
+	}
+	return true, maxAge, lastModified
+}
+
+// parseMaxAge extracts the max-age directive from a Cache-Control value
+func parseMaxAge(cacheControl string) (int64, bool) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value := directive, ""
+		if i := strings.Index(directive, "="); i >= 0 {
+			name, value = directive[:i], directive[i+1:]
+		}
+		if strings.EqualFold(strings.TrimSpace(name), "max-age") {
+			age, err := strconv.ParseInt(strings.Trim(strings.TrimSpace(value), `"`), 10, 64)
+			return age, err == nil
+		}
+	}
+	return 0, false
+}
+
+// fetch sends req to its origin server and stores the response in the cache
+// if it is cacheable. When the response is stored, its body has already been
+// read by the cache and is replaced with the buffered copy, so callers can
+// always read resp.Body. It reports whether the response was stored
+// Hosts that recently failed DNS or connect are not contacted again until
+// their negative cache entry expires
+func (p *forwardProxy) fetch(req *http.Request, group *clientGroup) (*http.Response, bool, error) {
+	if err := p.negative.check(urlHostKey(req)); err != nil {
+		return nil, false, err
+	}
+	client := &http.Client{Transport: p.transport(group)}
+	req.RequestURI = ""
+	p.filters.restrictEncodings(req.Header)
+	resp, err := client.Do(req)
+	if err != nil {
+		if isDialError(err) {
+			p.negative.recordFailure(urlHostKey(req), err)
+		}
+		return nil, false, err
+	}
+
+	// Filter the response before it is cached, so a blocked body is never
+	// stored and a truncated one is not mistaken for the whole
+	rule, truncated := p.filters.apply(req, resp)
+	if rule != nil {
+		resp.Body.Close()
+		return nil, false, &blockedResponseError{url: req.URL.String(), rule: rule}
+	}
+
+	// Helps with making sure the resp.Body is not read before sending it to the client while caching it
+	var box bytes.Buffer
+	stored := false
+	if req.Method == "GET" && !truncated {
+		cacheable, maxAge, lastModified := parseCacheHeaders(resp.Header)
+		// Error responses without Cache-Control are cached briefly
+		if !cacheable {
+			if ttl, ok := p.negative.statusMaxAge(resp.StatusCode, resp.Header); ok {
+				cacheable, maxAge = true, ttl
+			}
+		}
+		// Per-host policy overrides are applied after the headers are parsed
+		policy := p.policies.match(req.URL)
+		cacheable, maxAge = policy.apply(resp.Header, cacheable, maxAge)
+		if cacheable {
+			// The cache reads the whole body before the client gets any of
+			// it, so read it through the filters first: a body they block
+			// can still get the block page, and one they cut is not stored
+			var body bytes.Buffer
+			_, err := io.Copy(&body, resp.Body)
+			resp.Body.Close()
+			resp.Body = io.NopCloser(&body)
+			if err != nil && err != errBodyTruncated {
+				return nil, false, err
+			}
+			if err == nil {
+				// A max-age of -1 stores without max-age, i.e. always refetch the data
+				box = p.cache.Put(policy.keyRequest(req), resp, maxAge, lastModified)
+				stored = true
+			}
+		} else {
+			log.Println("Not cacheable")
+		}
+	}
+	if stored {
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(box.Bytes()))
+	}
+	return resp, stored, nil
+}
+
 // handleTunneling handles the CONNECT method for a forward proxy
 // by establishing a secure tunnel for HTTPS connections
-func (p *forwardProxy) handleTunneling(w http.ResponseWriter, req *http.Request) {
+func (p *forwardProxy) handleTunneling(w http.ResponseWriter, req *http.Request, user string, group *clientGroup, groupName string) {
 	log.Printf("Handling CONNECT for %s\n", req.Host)
 
+	// Fail fast if the host could not be reached moments ago
+	if err := p.negative.check(hostKey(req.Host, "443")); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
 	// Establish a TCP connection to the requested host
 	// log.Println("Attempting to connect to the destination host")
-	destConn, err := net.DialTimeout("tcp", req.Host, 10*time.Second)
+	ctx, cancel := context.WithTimeout(req.Context(), 10*time.Second)
+	destConn, err := p.dialer(group)(ctx, "tcp", req.Host)
+	cancel()
 	if err != nil {
 		// log.Printf("Error connecting to destination host: %v\n", err)
+		var blockedAddr *blockedAddrError
+		if errors.As(err, &blockedAddr) {
+			p.serveBlocked(w, req, blockedAddr.rule, user, groupName)
+			return
+		}
+		p.negative.recordFailure(hostKey(req.Host, "443"), err)
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
@@ -256,7 +471,7 @@ func (p *forwardProxy) handleTunneling(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	clientConn, _, err := hijacker.Hijack()
+	clientConn, clientBuf, err := hijacker.Hijack()
 	if err != nil {
 		// log.Printf("Error hijacking the connection: %v\n", err)
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
@@ -269,14 +484,101 @@ func (p *forwardProxy) handleTunneling(w http.ResponseWriter, req *http.Request)
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	// Start the transfer goroutines with the WaitGroup
-	go transfer(destConn, clientConn, &wg)
+	// Relay the destination's data right away, so protocols in which the
+	// server speaks first are not held up by the check below
 	go transfer(clientConn, destConn, &wg)
 
+	// Check the server name the client asks for in its TLS ClientHello
+	// before relaying anything the client sends
+	source, ok := p.checkTunnelSNI(clientConn, clientBuf.Reader, req, user, group, groupName)
+	if !ok {
+		clientConn.Write(tlsAccessDenied)
+		destConn.Close()
+		wg.Done()
+		wg.Wait()
+		return
+	}
+	go transfer(destConn, source, &wg)
+
 	// Wait for both transfers to complete before closing the connections
 	wg.Wait()
 }
 
+// checkTunnelSNI reads the first bytes the client sends on a tunnel and, if
+// they are a TLS ClientHello, applies the block lists to the server name it
+// asks for. A client could otherwise CONNECT to an address or an allowed
+// name and then ask the server for a blocked one. Tunnels whose server name
+// differs from the CONNECT host name or is blocked are rejected. Clients
+// that do not speak TLS, or wait for the server to speak first, can only
+// be checked by the CONNECT host
+// It returns the client side of the tunnel, including the bytes already
+// read, and whether the tunnel may proceed
+func (p *forwardProxy) checkTunnelSNI(clientConn net.Conn, r *bufio.Reader, req *http.Request, user string, group *clientGroup, groupName string) (io.ReadCloser, bool) {
+	clientConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer clientConn.SetReadDeadline(time.Time{})
+
+	if first, err := r.Peek(1); err != nil || first[0] != 0x16 {
+		return tunnelReader{Reader: r, Closer: clientConn}, true
+	}
+	sni, hello, err := readClientHello(r)
+	if err != nil {
+		log.Printf("Rejected tunnel to %s: invalid TLS ClientHello: %v\n", req.Host, err)
+		p.audit.record(req, nil, user, groupName, "", "invalid TLS ClientHello")
+		return nil, false
+	}
+	source := tunnelReader{Reader: io.MultiReader(bytes.NewReader(hello), r), Closer: clientConn}
+	if sni == "" {
+		return source, true
+	}
+
+	host := req.URL.Hostname()
+	if net.ParseIP(host) == nil && !strings.EqualFold(strings.TrimSuffix(sni, "."), strings.TrimSuffix(host, ".")) {
+		log.Printf("Rejected tunnel to %s: TLS server name %s does not match\n", req.Host, sni)
+		p.audit.record(req, nil, user, groupName, "", "TLS server name does not match")
+		return nil, false
+	}
+	if blocked, rule := p.blockedSet.MatchFor(sni, group); blocked {
+		if rule != nil {
+			log.Println("Rejected tunnel to", req.Host, "for TLS server name", sni, "blocked by rule", rule, "for group", groupName)
+		} else {
+			log.Println("Rejected tunnel to", req.Host, "for TLS server name", sni, "blocked by default-deny mode for group", groupName)
+		}
+		p.audit.record(req, rule, user, groupName, "", "TLS server name "+blockReason(rule))
+		return nil, false
+	}
+	return source, true
+}
+
+// serveBlocked answers a blocked request with the block page, logs the rule
+// that blocked it, or default-deny mode when rule is nil, and records it in
+// the audit log
+func (p *forwardProxy) serveBlocked(w http.ResponseWriter, req *http.Request, rule *blockRule, user, groupName string) {
+	requestID := p.blockPage.serve(w, req, rule, groupName)
+	p.audit.record(req, rule, user, groupName, requestID, blockReason(rule))
+	if rule != nil {
+		log.Println("Forbidden Content, blocked by rule", rule, "for group", groupName, "request", requestID)
+	} else {
+		log.Println("Forbidden Content, blocked by default-deny mode for group", groupName, "request", requestID)
+	}
+}
+
+// copyFiltered copies a body checked by the response filters to the client
+// and returns the number of bytes copied. A filter blocking the body after
+// the headers went out can no longer show the block page, so the response
+// is aborted, leaving the client with an error rather than a page that looks
+// complete, and the block is logged and audited
+func (p *forwardProxy) copyFiltered(w http.ResponseWriter, req *http.Request, body io.Reader, user, groupName string) int64 {
+	n, err := io.Copy(w, body)
+	var blocked *blockedResponseError
+	if errors.As(err, &blocked) {
+		requestID := newRequestID()
+		p.audit.record(req, blocked.rule, user, groupName, requestID, blockReason(blocked.rule))
+		log.Println("Forbidden Content, aborted response blocked by rule", blocked.rule, "for group", groupName, "request", requestID)
+		panic(http.ErrAbortHandler)
+	}
+	return n
+}
+
 // transfer handles the transfer of data from the source to the destination
 // to relay data between a client and a server
 func transfer(destination io.WriteCloser, source io.ReadCloser, wg *sync.WaitGroup) {
@@ -321,17 +623,199 @@ func main() {
 
 	// Note to Grader: Uncomment if you want to test locally with client.go
 	//var addr = flag.String("addr", "127.0.0.1:9999", "proxy address")
+	var policyFile = flag.String("cache-policy", "cache-policy.txt", "per-host cache policy rules (ignored if missing)")
+	var gcInterval = flag.Duration("gc-interval", 10*time.Minute, "how often unreferenced cached bodies are deleted")
+	var blocklists = flag.String("blocklists", "blocked-domains.txt", "comma-separated block lists, each [name=][format:]path with format rules, hosts, domains or abp; path may be an http(s) URL")
+	var groupsFile = flag.String("client-groups", "client-groups.txt", "per-client block list groups (ignored if missing)")
+	var usersFile = flag.String("users", "", "user:password file; enables proxy authentication")
+	var hashPasswordFlag = flag.Bool("hash-password", false, "read a password from standard input, print its salted hash for the -users file, then exit")
+	var blockPageFile = flag.String("block-page", "", "HTML template for the block page (default: built-in page)")
+	var blockStatus = flag.Int("block-status", http.StatusForbidden, "status code for blocked requests, 403 or 451")
+	var blockContact = flag.String("block-contact", "", "who to contact about blocks, shown on the block page")
+	var auditFile = flag.String("audit-log", "", "file to record blocked requests to, one JSON object per line")
+	var auditMaxSize = flag.String("audit-max-size", "10MB", "size at which the audit log is rotated")
+	var auditMaxFiles = flag.Int("audit-max-files", 5, "rotated audit logs to keep")
+	var safeSearchFile = flag.String("safe-search", "safe-search.txt", "query parameters and headers forcing safe search, per host (ignored if missing)")
+	var responseFiltersFile = flag.String("response-filters", "response-filters.txt", "content type, extension and size filters for responses (ignored if missing)")
+	var defaultDeny = flag.Bool("default-deny", false, "block every host that no rule in the block lists allows")
+	var blocklistReload = flag.Duration("blocklist-reload", 5*time.Second, "how often the block list files are checked for changes (0 disables)")
+	var blocklistRefresh = flag.Duration("blocklist-refresh", time.Hour, "how often block lists given by URL are fetched again (0 disables)")
+	var scrubInterval = flag.Duration("scrub-interval", time.Hour, "how often the whole cache is checked for corrupt entries (0 disables)")
+	var offline = flag.Bool("offline", false, "start in offline mode, serving only from the cache")
+	var offlineAfter = flag.Int("offline-after", 5, "consecutive dial failures before switching to offline mode (0 disables)")
+	var offlineHosts = flag.Int("offline-hosts", 3, "different hosts the dial failures must be against before switching to offline mode")
+	var offlineRetry = flag.Duration("offline-retry", 30*time.Second, "how often to retry the origin while offline")
+	var negativeStatuses = flag.String("negative-statuses", "404,410", "response status codes to cache briefly when they have no Cache-Control header")
+	var negativeTTL = flag.Duration("negative-ttl", 30*time.Second, "how long to cache negative responses (0 disables)")
+	var negativeErrorTTL = flag.Duration("negative-error-ttl", 10*time.Second, "how long to remember DNS and connection failures per host (0 disables)")
+	var peerList = flag.String("peers", "", "comma-separated URLs of sibling proxies, e.g. http://10.8.75.18:9999")
+	var self = flag.String("self", "", "this proxy's URL as listed in the other peers' -peers (default http://<addr>)")
+	var peerTimeout = flag.Duration("peer-timeout", 2*time.Second, "timeout for queries to sibling proxies")
+	var peerHealth = flag.Duration("peer-health", 10*time.Second, "how often to probe sibling proxies")
+	var warm = flag.String("warm", "", "warm the cache from a URL list or sitemap (file or URL), then exit")
+	var warmConcurrency = flag.Int("warm-concurrency", 4, "maximum concurrent fetches while warming")
+	var warmRate = flag.Float64("warm-rate", 10, "maximum fetches started per second while warming (0 for unlimited)")
+	var exportWARC = flag.String("export-warc", "", "write the cache to a WARC file (gzipped if it ends in .gz), then exit")
+	var importWARC = flag.String("import-warc", "", "populate the cache from a WARC file, then exit")
+	var exportHAR = flag.String("export-har", "", "write a browsing session from the cache to a HAR file, then exit")
+	var harSince = flag.String("har-since", "", "only export entries cached at or after this RFC 3339 time to HAR")
+	var harHost = flag.String("har-host", "", "only export entries for this host to HAR")
 	flag.Parse()
 
-	blockedSet, err := NewBlockedSet("blocked-domains.txt")
+	if *hashPasswordFlag {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatal(err)
+		}
+		entry, err := hashPassword(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(entry)
+		return
+	}
+
+	var lists []string
+	for _, list := range strings.Split(*blocklists, ",") {
+		if list = strings.TrimSpace(list); list != "" {
+			lists = append(lists, list)
+		}
+	}
+	blockedSet, err := NewBlockedSet(lists...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	blockedSet.SetDefaultDeny(*defaultDeny)
+	if *blocklistReload > 0 {
+		go blockedSet.Watch(*blocklistReload)
+	}
+	if *blocklistRefresh > 0 {
+		go blockedSet.Refresh(*blocklistRefresh)
+	}
+
+	// Reload the blocked domains on SIGHUP as well, without dropping tunnels
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := blockedSet.Reload(); err != nil {
+				log.Printf("Error reloading blocked domains, keeping the old list: %v\n", err)
+				continue
+			}
+			log.Println("Reloaded blocked domains on SIGHUP")
+		}
+	}()
+	groups, err := loadClientGroups(*groupsFile, blockedSet.ListNames())
+	if err != nil {
+		log.Fatal(err)
+	}
+	var users *proxyUsers
+	if *usersFile != "" {
+		if users, err = loadProxyUsers(*usersFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	blockPage, err := newBlockPage(*blockPageFile, *blockStatus, *blockContact)
+	if err != nil {
+		log.Fatal(err)
+	}
+	auditSize, err := parseSize(*auditMaxSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	audit, err := newAuditLog(*auditFile, auditSize, *auditMaxFiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	safeSearch, err := loadSafeSearch(*safeSearchFile)
 	if err != nil {
 		log.Fatal(err)
 	}
+	filters, err := loadResponseFilters(*responseFiltersFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	policies, err := loadCachePolicies(*policyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	negative, err := newNegativeCache(*negativeStatuses, *negativeTTL, *negativeErrorTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *self == "" {
+		*self = "http://" + *addr
+	}
+	peers, err := newPeerSet(*self, splitPeers(*peerList), *peerTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go peers.checkHealth(*peerHealth)
 	cache := NewHTTPCache()
 
+	// Periodically delete response bodies that no cached URL refers to
+	// anymore and report how much space deduplication is saving
+	go func() {
+		for range time.Tick(*gcInterval) {
+			removed, freed := cache.CollectGarbage()
+			stats := cache.DedupStats()
+			log.Printf("Cache GC removed %d bodies (%d bytes); %d bodies shared by %d URLs, %d bytes saved\n",
+				removed, freed, stats.Blobs, stats.References, stats.SavedBytes)
+		}
+	}()
+
+	// Periodically check every cached entry so corruption is found before a
+	// client asks for the entry
+	if *scrubInterval > 0 {
+		go func() {
+			for range time.Tick(*scrubInterval) {
+				cache.Scrub()
+			}
+		}()
+	}
+
 	proxy := &forwardProxy{
 		blockedSet: blockedSet,
+		groups:     groups,
+		users:      users,
+		blockPage:  blockPage,
+		filters:    filters,
+		audit:      audit,
+		safeSearch: safeSearch,
 		cache:      cache,
+		offline:    newOfflineMode(*offlineAfter, *offlineHosts, *offlineRetry),
+		policies:   policies,
+		negative:   negative,
+		peers:      peers,
+	}
+	proxy.admin = newAdminMux(proxy)
+	if *offline {
+		proxy.offline.SetManual(true)
+	}
+
+	// Archive export and import run on their own and exit when done
+	if *exportWARC != "" || *exportHAR != "" || *importWARC != "" {
+		if err := runArchiveCommand(cache, *exportWARC, *importWARC, *exportHAR, *harSince, *harHost); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Warm-up runs on its own: fill the cache, print the report and exit
+	if *warm != "" {
+		data, err := proxy.readWarmSource(*warm)
+		if err != nil {
+			log.Fatal(err)
+		}
+		urls, err := proxy.parseWarmURLs(data)
+		if err != nil {
+			log.Fatal(err)
+		}
+		report := proxy.warmCache(urls, *warmConcurrency, *warmRate)
+		for _, r := range report.Results {
+			fmt.Printf("%-8s %s %s\n", r.Outcome, r.URL, r.Reason)
+		}
+		return
 	}
 
 	log.Println("Starting proxy server on", *addr)
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestProxy returns a proxy with an empty cache in a temporary directory
+// and none of the optional lists, filters or peers configured
+func newTestProxy(t *testing.T) *forwardProxy {
+	t.Helper()
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.txt")
+	blockedSet := newTestBlockedSet(t)
+	groups, err := loadClientGroups(missing, blockedSet.ListNames())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockPage, err := newBlockPage("", http.StatusForbidden, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := newAuditLog("", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	safeSearch, err := loadSafeSearch(missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters, err := loadResponseFilters(missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies, err := loadCachePolicies(missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	negative, err := newNegativeCache("404,410", 30*time.Second, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers, err := newPeerSet("http://127.0.0.1:9999", nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &forwardProxy{
+		blockedSet: blockedSet,
+		groups:     groups,
+		blockPage:  blockPage,
+		filters:    filters,
+		audit:      audit,
+		safeSearch: safeSearch,
+		cache:      newHTTPCacheAt(filepath.Join(dir, "cache")),
+		offline:    newOfflineMode(5, 3, 30*time.Second),
+		policies:   policies,
+		negative:   negative,
+		peers:      peers,
+	}
+	p.admin = newAdminMux(p)
+	return p
+}
+
+// putStale caches body for rawURL as a response that went stale an hour ago
+func putStale(t *testing.T, c *HTTPCache, rawURL, body string) {
+	t.Helper()
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}
+	c.PutAt(mustRequest(t, rawURL), resp, 60, "na", time.Now().Add(-2*time.Hour))
+}
+
+func TestOfflineStaleHitCountsOnce(t *testing.T) {
+	p := newTestProxy(t)
+	putStale(t, p.cache, "http://a.example/page", "old copy")
+	p.offline.SetManual(true)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, mustRequest(t, "http://a.example/page"))
+	if rec.Code != 200 || rec.Body.String() != "old copy" {
+		t.Fatalf("got %d %q, want the stale copy", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, mustRequest(t, "http://a.example/other"))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("uncached URL got %d while offline, want 504", rec.Code)
+	}
+
+	h := p.cache.Stats().Hosts["a.example"]
+	if h.StaleHits != 1 || h.Hits != 0 || h.Misses != 1 || h.HitRatio != 0.5 {
+		t.Errorf("got %d stale hits, %d hits, %d misses, ratio %v, want 1, 0, 1, 0.5",
+			h.StaleHits, h.Hits, h.Misses, h.HitRatio)
+	}
+}
+
+func TestUnreachableHostServesStale(t *testing.T) {
+	p := newTestProxy(t)
+	// Nothing listens on port 1, so dialing the origin fails
+	putStale(t, p.cache, "http://127.0.0.1:1/page", "old copy")
+
+	for _, detail := range []string{`detail="unreachable"`, `detail="negative"`} {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, mustRequest(t, "http://127.0.0.1:1/page"))
+		if rec.Code != 200 || rec.Body.String() != "old copy" {
+			t.Fatalf("got %d %q, want the stale copy", rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("Cache-Status"); !strings.Contains(got, detail) {
+			t.Errorf("Cache-Status is %q, want %s", got, detail)
+		}
+		if got := rec.Header().Values("Warning"); len(got) != 2 {
+			t.Errorf("Warning headers are %q, want stale and revalidation failed", got)
+		}
+	}
+
+	// With no copy, the negative cache still answers at once
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, mustRequest(t, "http://127.0.0.1:1/other"))
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Header().Get("Cache-Status"), "negative") {
+		t.Errorf("uncached URL got %d, Cache-Status %q, want a 502 from the negative cache", rec.Code, rec.Header().Get("Cache-Status"))
+	}
+
+	h := p.cache.Stats().Hosts["127.0.0.1"]
+	if h.StaleHits != 2 || h.Misses != 1 {
+		t.Errorf("got %d stale hits and %d misses, want 2 and 1", h.StaleHits, h.Misses)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// blocklistCacheDir holds the last good copy of every block list fetched
+// from a URL, so the proxy can start with them when the server is down
+const blocklistCacheDir = "./blocklist_cache"
+
+// blocklistClient fetches block lists published over HTTP
+var blocklistClient = &http.Client{Timeout: 30 * time.Second}
+
+// remoteMeta is kept next to the cached copy of a list to make the next
+// fetch conditional
+type remoteMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+// isListURL reports whether a block list is given by URL rather than path
+func isListURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// remoteListName is the default name of a list fetched from rawURL: the
+// file name in its path without the extension, or else its host
+func remoteListName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	base := path.Base(u.Path)
+	if base = strings.TrimSuffix(base, path.Ext(base)); base != "" && base != "." && base != "/" {
+		return base
+	}
+	return u.Hostname()
+}
+
+// remoteListPath is where the copy of the list fetched from rawURL is kept
+// The URL's hash keeps lists with the same name apart
+func remoteListPath(name, rawURL string) string {
+	sum := sha256.Sum256([]byte(rawURL))
+	return filepath.Join(blocklistCacheDir, name+"-"+hex.EncodeToString(sum[:6])+".txt")
+}
+
+// readMeta returns what the last successful fetch of the list recorded
+// It is empty when the list was never fetched or its URL has changed
+func (l *blockList) readMeta() remoteMeta {
+	var meta remoteMeta
+	data, err := os.ReadFile(l.filename + ".meta")
+	if err != nil || json.Unmarshal(data, &meta) != nil || meta.URL != l.url {
+		return remoteMeta{}
+	}
+	if _, err := os.Stat(l.filename); err != nil {
+		return remoteMeta{}
+	}
+	return meta
+}
+
+// fetch downloads the list from its URL into the cached copy, asking the
+// server to skip the download when the list has not changed since the last
+// fetch (ETag and If-Modified-Since). A download that cannot be parsed is
+// rejected and the last good copy is kept. It reports whether a new copy
+// was stored
+func (l *blockList) fetch() (bool, error) {
+	meta := l.readMeta()
+	req, err := http.NewRequest("GET", l.url, nil)
+	if err != nil {
+		return false, err
+	}
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+	resp, err := blocklistClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && meta.URL != "" {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("fetching %s: %s", l.url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("fetching %s: %v", l.url, err)
+	}
+	if _, _, err := l.parse(bytes.NewReader(data)); err != nil {
+		return false, err
+	}
+
+	// Replace the copy in one step, so a reload never reads half a list
+	if err := os.MkdirAll(blocklistCacheDir, os.ModePerm); err != nil {
+		return false, err
+	}
+	tmp := l.filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, l.filename); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	meta = remoteMeta{
+		URL:          l.url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Fetched:      time.Now(),
+	}
+	if data, err := json.Marshal(meta); err == nil {
+		os.WriteFile(l.filename+".meta", data, 0644)
+	}
+	log.Printf("Fetched block list %s from %s (%d bytes)\n", l.name, l.url, len(data))
+	return true, nil
+}
+
+// Refresh fetches the lists given by URL each interval and reloads the
+// lists when one of them changed. A list that cannot be fetched, or whose
+// new version does not parse, is logged and its last good copy stays in use
+func (bs *BlockedSet) Refresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		updated := false
+		for _, list := range bs.lists {
+			if list.url == "" {
+				continue
+			}
+			fetched, err := list.fetch()
+			if err != nil {
+				log.Printf("Error refreshing block list %s, keeping the last good copy: %v\n", list.name, err)
+				continue
+			}
+			updated = updated || fetched
+		}
+		if !updated {
+			continue
+		}
+		if err := bs.Reload(); err != nil {
+			log.Printf("Error reloading blocked domains, keeping the old lists: %v\n", err)
+			continue
+		}
+		log.Println("Reloaded blocked domains after refreshing lists")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// requestFilter limits a rule to some of the requests to the hosts it
+// matches, by method, path and query parameters
+type requestFilter struct {
+	methods map[string]bool // Methods the rule applies to; nil means any
+	paths   []string        // Path globs, one of which must match; empty means any
+	query   []queryParam    // Query parameters that must all be present
+}
+
+// queryParam is a query parameter a request must carry, with any value
+// unless value is set
+type queryParam struct {
+	key      string
+	value    string
+	anyValue bool
+}
+
+// parseRequestFilter builds a filter from the options following a rule:
+//
+//	method=POST,PUT     only requests with one of these methods
+//	path=/admin/*       only paths matching the glob; a trailing '*' matches
+//	                    any remainder. May be given more than once
+//	query=key[=value]   only requests with this query parameter, or with
+//	                    this value for it. May be given more than once
+//
+// It returns nil when no option is given
+func parseRequestFilter(options []string) (*requestFilter, error) {
+	if len(options) == 0 {
+		return nil, nil
+	}
+	f := &requestFilter{}
+	for _, option := range options {
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "method":
+			f.methods = make(map[string]bool)
+			for _, method := range strings.Split(value, ",") {
+				if method == "" {
+					return nil, fmt.Errorf("invalid methods %q", value)
+				}
+				f.methods[strings.ToUpper(method)] = true
+			}
+		case "path":
+			if !strings.HasPrefix(value, "/") {
+				return nil, fmt.Errorf("path must start with '/', got %q", value)
+			}
+			if _, err := path.Match(value, "/"); err != nil {
+				return nil, fmt.Errorf("invalid path pattern %q", value)
+			}
+			f.paths = append(f.paths, value)
+		case "query":
+			key, val, hasValue := strings.Cut(value, "=")
+			if key == "" {
+				return nil, fmt.Errorf("invalid query parameter %q", value)
+			}
+			f.query = append(f.query, queryParam{key: key, value: val, anyValue: !hasValue})
+		default:
+			return nil, fmt.Errorf("unknown option %q", option)
+		}
+	}
+	return f, nil
+}
+
+// matches reports whether req passes the filter. A nil filter matches every
+// request; any other filter needs the request, so it never matches when
+// only the host is known (req is nil), as for CONNECT tunnels
+func (f *requestFilter) matches(req *http.Request) bool {
+	if f == nil {
+		return true
+	}
+	if req == nil {
+		return false
+	}
+	if f.methods != nil && !f.methods[req.Method] {
+		return false
+	}
+	if len(f.paths) > 0 {
+		p := cleanPath(req.URL.Path)
+		matched := false
+		for _, pattern := range f.paths {
+			if matchPath(pattern, p) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	values := req.URL.Query()
+	for _, param := range f.query {
+		got, ok := values[param.key]
+		if !ok {
+			return false
+		}
+		if param.anyValue {
+			continue
+		}
+		found := false
+		for _, v := range got {
+			if v == param.value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// cleanPath resolves the "//", "." and ".." elements of a request path, as
+// the origin would, so they cannot be used to get around a path glob. A
+// path naming a directory, ending in "/", "/." or "/..", keeps its trailing
+// slash
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	cleaned := path.Clean("/" + p)
+	dir := strings.HasSuffix(p, "/") || strings.HasSuffix(p, "/.") || strings.HasSuffix(p, "/..")
+	if dir && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMatchRequestCleansPath(t *testing.T) {
+	bs := newTestBlockedSet(t,
+		"site.example path=/admin/*",
+		"dir.example path=/private/",
+	)
+	tests := []struct {
+		url     string
+		blocked bool
+	}{
+		{"http://site.example/admin/x", true},
+		{"http://site.example//admin/x", true},
+		{"http://site.example/./admin/x", true},
+		{"http://site.example/a/../admin/x", true},
+		{"http://site.example/admin/./x/../y", true},
+		{"http://site.example/%2e%2e/admin/x", true},
+		{"http://site.example/a/%2e%2e/admin/x", true},
+		{"http://site.example/admin/../public/x", false},
+		{"http://site.example/public/x", false},
+		{"http://site.example/", false},
+		{"http://dir.example/private/", true},
+		{"http://dir.example//private//", true},
+		{"http://dir.example/x/../private/.", true},
+		{"http://dir.example/private/x/..", true},
+		{"http://dir.example/private", false},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := bs.MatchRequest(req, nil); got != tt.blocked {
+			t.Errorf("MatchRequest(%s) = %v, want %v", tt.url, got, tt.blocked)
+		}
+	}
+}
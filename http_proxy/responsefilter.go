@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// responseFilters blocks responses by what the origin sends back rather
+// than by the host asked for: their Content-Type, the file extension of the
+// URL or download, their size and, for text, what their body says
+type responseFilters struct {
+	types    []typeRule
+	exts     map[string]*blockRule // Lower-case extensions with the dot, e.g. ".exe"
+	maxSize  int64                 // Body size limit in bytes; 0 means none
+	truncate bool                  // Cut bodies at maxSize rather than blocking them
+	sizeRule *blockRule            // The max-size line, for the block page
+
+	bodies      []bodyRule // Keyword and regex rules for text bodies, see bodyfilter.go
+	scanLimit   int64      // How much of a text body is scanned
+	undecodable *blockRule // Reported for text bodies that cannot be decoded to scan them
+}
+
+// typeRule blocks responses whose media type matches a glob such as video/*
+type typeRule struct {
+	pattern string
+	rule    *blockRule
+}
+
+// blockedResponseError is returned instead of a response a filter blocked
+type blockedResponseError struct {
+	url  string
+	rule *blockRule
+}
+
+func (e *blockedResponseError) Error() string {
+	return fmt.Sprintf("response from %s blocked by rule %s", e.url, e.rule)
+}
+
+// filteredBody is a response body replaced by the filters, which still
+// closes the original body
+type filteredBody struct {
+	io.Reader
+	io.Closer
+}
+
+// errBodyTruncated ends a body that max-size with truncate cut short. What
+// was read before it is the whole response the client gets
+var errBodyTruncated = errors.New("body truncated at max-size")
+
+// sizeLimitedBody enforces max-size on a body whose length was not
+// announced. Bytes are counted as they are passed on, so the body streams
+// to the client rather than being read ahead to measure it. A body going
+// over the limit ends there with a blockedResponseError, or with
+// errBodyTruncated when the filter truncates
+type sizeLimitedBody struct {
+	io.ReadCloser
+	f    *responseFilters
+	url  string
+	left int64 // Bytes that may still be read
+}
+
+func (b *sizeLimitedBody) Read(p []byte) (int, error) {
+	// Ask for one byte past the limit, to notice going over it
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.left {
+		b.left -= int64(n)
+		return n, err
+	}
+	n, b.left = int(b.left), 0
+	if !b.f.truncate {
+		return n, &blockedResponseError{url: b.url, rule: b.f.sizeRule}
+	}
+	log.Printf("Truncated response from %s to %d bytes by rule %s\n", b.url, b.f.maxSize, b.f.sizeRule)
+	return n, errBodyTruncated
+}
+
+// loadResponseFilters reads response filters from filename. Each line holds
+// a directive followed by its values:
+//
+//	type application/x-msdownload video/*   block these media types (globs)
+//	ext .exe .msi                            block URLs and downloads with these extensions
+//	max-size 100MB [truncate]                block bodies over this size, or cut them
+//	keyword casino bonus                     block text bodies containing the phrase
+//	regex (?i)free\s+spins                   block text bodies the regexp matches
+//	scan-limit 1MB                           how much of a text body to scan
+//
+// Sizes are in bytes, or in KB, MB or GB (powers of 1024). Blank lines and
+// lines starting with '#' are ignored. A missing file means no filters
+func loadResponseFilters(filename string) (*responseFilters, error) {
+	f := &responseFilters{
+		exts:        make(map[string]*blockRule),
+		scanLimit:   defaultScanLimit,
+		undecodable: &blockRule{text: "text body that cannot be decoded for scanning", list: "responses", source: filename},
+	}
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := &blockRule{text: line, list: "responses", source: fmt.Sprintf("%s:%d", filename, lineNo)}
+		if err := f.add(strings.Fields(line), rule); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineNo, err)
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d response filters from %s\n", count, filename)
+	return f, nil
+}
+
+// add adds the directive of one line of the filters file
+func (f *responseFilters) add(fields []string, rule *blockRule) error {
+	if len(fields) < 2 {
+		return fmt.Errorf("expected a directive followed by values")
+	}
+	values := fields[1:]
+	switch fields[0] {
+	case "type":
+		for _, pattern := range values {
+			pattern = strings.ToLower(pattern)
+			if _, err := path.Match(pattern, ""); err != nil || !strings.Contains(pattern, "/") {
+				return fmt.Errorf("invalid media type %q", pattern)
+			}
+			f.types = append(f.types, typeRule{pattern: pattern, rule: rule})
+		}
+	case "ext":
+		for _, ext := range values {
+			ext = strings.ToLower(ext)
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			if ext == "." || strings.Contains(ext[1:], ".") {
+				return fmt.Errorf("invalid extension %q", ext)
+			}
+			f.exts[ext] = rule
+		}
+	case "max-size":
+		if f.sizeRule != nil {
+			return fmt.Errorf("max-size is already set at %s", f.sizeRule.source)
+		}
+		size, err := parseSize(values[0])
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(values) == 1:
+		case len(values) == 2 && values[1] == "truncate":
+			f.truncate = true
+		default:
+			return fmt.Errorf("unexpected %q after max-size", strings.Join(values[1:], " "))
+		}
+		f.maxSize, f.sizeRule = size, rule
+	case "keyword", "regex":
+		return f.addBodyRule(fields[0], strings.TrimSpace(strings.TrimPrefix(rule.text, fields[0])), rule)
+	case "scan-limit":
+		if len(values) != 1 {
+			return fmt.Errorf("expected one size after scan-limit")
+		}
+		size, err := parseSize(values[0])
+		if err != nil {
+			return err
+		}
+		f.scanLimit = size
+	default:
+		return fmt.Errorf("unknown directive %q", fields[0])
+	}
+	return nil
+}
+
+// parseSize parses a size such as "512", "64KB" or "1GB" into bytes
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.ToUpper(value)
+	for i, unit := range []string{"KB", "MB", "GB"} {
+		if strings.HasSuffix(number, unit) {
+			number = strings.TrimSuffix(number, unit)
+			multiplier = 1 << (10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// match returns the type or extension rule blocking a response to u with
+// the given headers, or nil. The extension is taken from the URL path and
+// from the file name in Content-Disposition, since downloads are often
+// served from URLs that do not end in one
+func (f *responseFilters) match(u *url.URL, header http.Header) *blockRule {
+	if mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil {
+		for _, t := range f.types {
+			if matched, _ := path.Match(t.pattern, mediaType); matched {
+				return t.rule
+			}
+		}
+	}
+	if rule := f.exts[strings.ToLower(path.Ext(u.Path))]; rule != nil {
+		return rule
+	}
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		if rule := f.exts[strings.ToLower(path.Ext(params["filename"]))]; rule != nil {
+			return rule
+		}
+	}
+	return nil
+}
+
+// apply checks a response, from the origin, the cache or a peer, against
+// the filters and returns the rule blocking it, or nil. It also enforces the
+// size limit: a body announced as too large is blocked, or cut with
+// truncate, and one whose length is not announced is counted as it is read,
+// see sizeLimitedBody. Text bodies are then scanned, see scanBody. It
+// reports whether the body was cut up front, in which case the response
+// must not be cached
+func (f *responseFilters) apply(req *http.Request, resp *http.Response) (*blockRule, bool) {
+	if rule := f.match(req.URL, resp.Header); rule != nil {
+		return rule, false
+	}
+	truncated := false
+	switch {
+	case f.maxSize == 0 || resp.ContentLength >= 0 && resp.ContentLength <= f.maxSize:
+	case resp.ContentLength < 0:
+		resp.Body = &sizeLimitedBody{ReadCloser: resp.Body, f: f, url: req.URL.String(), left: f.maxSize}
+	case !f.truncate:
+		return f.sizeRule, false
+	default:
+		resp.Body = filteredBody{Reader: io.LimitReader(resp.Body, f.maxSize), Closer: resp.Body}
+		log.Printf("Truncated response from %s to %d bytes by rule %s\n", req.URL, f.maxSize, f.sizeRule)
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		truncated = true
+	}
+	return f.scanBody(req, resp), truncated
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// safeSearchRule forces safe search on the requests to a host, and
+// optionally a path, by setting query parameters and headers
+type safeSearchRule struct {
+	urlPattern
+	query   [][2]string // Query parameters to set, as key and value
+	headers [][2]string // Request headers to set, as name and value
+}
+
+// safeSearch is the ordered list of safe search rules; the first rule whose
+// pattern matches a request applies
+type safeSearch struct {
+	rules []*safeSearchRule
+}
+
+// loadSafeSearch reads safe search rules from filename. Each line holds a
+// pattern, written as for cache policies, followed by what to set, e.g.
+//
+//	*.google.com/search  query:safe=active
+//	www.youtube.com      header:YouTube-Restrict=Strict
+//
+// query:key=value replaces the values of a query parameter and
+// header:Name=value those of a request header. Blank lines and lines
+// starting with '#' are ignored. A missing file means no rewriting
+func loadSafeSearch(filename string) (*safeSearch, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return &safeSearch{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []*safeSearchRule
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseSafeSearchRule(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineNo, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d safe search rules from %s\n", len(rules), filename)
+	return &safeSearch{rules: rules}, nil
+}
+
+// parseSafeSearchRule builds a rule from the fields of one line of the rules file
+func parseSafeSearchRule(fields []string) (*safeSearchRule, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected a pattern followed by query: or header: settings")
+	}
+	pattern, err := parseURLPattern(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	rule := &safeSearchRule{urlPattern: pattern}
+
+	for _, setting := range fields[1:] {
+		kind, assignment, _ := strings.Cut(setting, ":")
+		name, value, ok := strings.Cut(assignment, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid setting %q, expected query:key=value or header:Name=value", setting)
+		}
+		switch kind {
+		case "query":
+			rule.query = append(rule.query, [2]string{name, value})
+		case "header":
+			rule.headers = append(rule.headers, [2]string{http.CanonicalHeaderKey(name), value})
+		default:
+			return nil, fmt.Errorf("unknown setting %q", setting)
+		}
+	}
+	return rule, nil
+}
+
+// rewrite applies the first rule matching req to it, before the request is
+// looked up in the cache and forwarded. Only plain HTTP requests are
+// rewritten: the proxy does not intercept TLS, so HTTPS requests inside
+// CONNECT tunnels pass through untouched
+func (ss *safeSearch) rewrite(req *http.Request) {
+	for _, rule := range ss.rules {
+		if !rule.matches(req.URL) {
+			continue
+		}
+
+		for _, kv := range rule.query {
+			req.URL.RawQuery = setQueryParam(req.URL.RawQuery, kv[0], kv[1])
+		}
+		for _, kv := range rule.headers {
+			req.Header.Set(kv[0], kv[1])
+		}
+		log.Printf("Enforced safe search on %s by rule %s\n", req.URL, rule.pattern)
+		return
+	}
+}
+
+// setQueryParam sets key to value in rawQuery, replacing the first value
+// the client sent in place and dropping any others. The rest of the query is
+// kept byte for byte and in order, rather than decoded and encoded again
+func setQueryParam(rawQuery, key, value string) string {
+	param := url.QueryEscape(key) + "=" + url.QueryEscape(value)
+	if rawQuery == "" {
+		return param
+	}
+	var pairs []string
+	set := false
+	for _, pair := range strings.Split(rawQuery, "&") {
+		name, _, _ := strings.Cut(pair, "=")
+		if unescaped, err := url.QueryUnescape(name); err != nil || unescaped != key {
+			pairs = append(pairs, pair)
+			continue
+		}
+		if !set {
+			pairs, set = append(pairs, param), true
+		}
+	}
+	if !set {
+		pairs = append(pairs, param)
+	}
+	return strings.Join(pairs, "&")
+}
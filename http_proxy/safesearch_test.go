@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSafeSearchRewrite(t *testing.T) {
+	ss := &safeSearch{}
+	for _, line := range [][]string{
+		{"*.search.example/search", "query:safe=active"},
+		{"video.example", "header:YouTube-Restrict=Strict"},
+	} {
+		rule, err := parseSafeSearchRule(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss.rules = append(ss.rules, rule)
+	}
+
+	tests := []struct {
+		url, want string
+	}{
+		// Parameters the rule does not set are kept as sent, in order
+		{"http://www.search.example/search?q=a+b&z=%7e&safe=off&a=1", "http://www.search.example/search?q=a+b&z=%7e&safe=active&a=1"},
+		{"http://www.search.example/search?safe=off&q=x&safe=images", "http://www.search.example/search?safe=active&q=x"},
+		{"http://www.search.example/search?q=x", "http://www.search.example/search?q=x&safe=active"},
+		{"http://www.search.example/search", "http://www.search.example/search?safe=active"},
+		// A fully qualified host name with a trailing dot matches too
+		{"http://www.search.example./search?q=x", "http://www.search.example./search?q=x&safe=active"},
+		{"http://www.search.example/images?q=x", "http://www.search.example/images?q=x"},
+		{"http://search.example/search?q=x", "http://search.example/search?q=x"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		ss.rewrite(req)
+		if got := req.URL.String(); got != tt.want {
+			t.Errorf("rewrite(%s) = %s, want %s", tt.url, got, tt.want)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://VIDEO.example./watch", nil)
+	req.Header.Set("YouTube-Restrict", "Off")
+	ss.rewrite(req)
+	if got := req.Header.Get("YouTube-Restrict"); got != "Strict" {
+		t.Errorf("YouTube-Restrict is %q, want Strict", got)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule limits a rule to certain days of the week and times of day
+type schedule struct {
+	days   [7]bool     // Days the rule applies on, indexed by time.Weekday
+	ranges []timeRange // Times of day the rule applies at; empty means all day
+	loc    *time.Location
+}
+
+// timeRange is a time of day range in minutes since midnight. A range whose
+// end is before its start runs past midnight into the next day
+type timeRange struct {
+	start, end int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseSchedule builds a schedule from the options following a rule:
+//
+//	days=mon-fri,sun        days of the week, as names and ranges of names
+//	hours=09:00-17:00,...   times of day; 22:00-06:00 runs past midnight
+//	tz=Europe/Sofia         time zone the days and hours are in (default local)
+//
+// It returns nil when no option is given
+func parseSchedule(options []string) (*schedule, error) {
+	if len(options) == 0 {
+		return nil, nil
+	}
+	s := &schedule{loc: time.Local}
+	daysSet := false
+	for _, option := range options {
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "days":
+			for _, part := range strings.Split(strings.ToLower(value), ",") {
+				from, to, isRange := strings.Cut(part, "-")
+				first, ok1 := weekdays[from]
+				last, ok2 := weekdays[to]
+				if !isRange {
+					last, ok2 = first, ok1
+				}
+				if !ok1 || !ok2 {
+					return nil, fmt.Errorf("invalid days %q", value)
+				}
+				for d := first; ; d = (d + 1) % 7 {
+					s.days[d] = true
+					if d == last {
+						break
+					}
+				}
+			}
+			daysSet = true
+		case "hours":
+			for _, part := range strings.Split(value, ",") {
+				from, to, ok := strings.Cut(part, "-")
+				start, err1 := parseClock(from)
+				end, err2 := parseClock(to)
+				if !ok || err1 != nil || err2 != nil || start == end {
+					return nil, fmt.Errorf("invalid hours %q", value)
+				}
+				s.ranges = append(s.ranges, timeRange{start: start, end: end})
+			}
+		case "tz":
+			loc, err := time.LoadLocation(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid time zone %q", value)
+			}
+			s.loc = loc
+		default:
+			return nil, fmt.Errorf("unknown option %q", option)
+		}
+	}
+	if !daysSet {
+		s.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	return s, nil
+}
+
+// parseClock parses a time of day such as "09:30" into minutes since midnight
+// "24:00" is accepted as the end of the day
+func parseClock(value string) (int, error) {
+	hours, minutes, ok := strings.Cut(value, ":")
+	h, err1 := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	if !ok || err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return h*60 + m, nil
+}
+
+// active reports whether the schedule applies at t
+// A nil schedule always applies
+func (s *schedule) active(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	t = t.In(s.loc)
+	today := t.Weekday()
+	if len(s.ranges) == 0 {
+		return s.days[today]
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	yesterday := (today + 6) % 7
+	for _, r := range s.ranges {
+		if r.start < r.end {
+			if s.days[today] && minute >= r.start && minute < r.end {
+				return true
+			}
+			continue
+		}
+		// The range runs past midnight: the part after midnight belongs to
+		// the day it started on
+		if s.days[today] && minute >= r.start || s.days[yesterday] && minute < r.end {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// at returns hh:mm UTC on the given day of the week starting Monday 1 Jan 2024
+func at(day time.Weekday, hh, mm int) time.Time {
+	return time.Date(2024, 1, 1+int(day+6)%7, hh, mm, 0, 0, time.UTC)
+}
+
+// mustSchedule parses a schedule written as in a rules file, in UTC
+func mustSchedule(t *testing.T, options string) *schedule {
+	t.Helper()
+	s, err := parseSchedule(append(strings.Fields(options), "tz=UTC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestScheduleWrapsPastMidnight(t *testing.T) {
+	s := mustSchedule(t, "days=fri hours=22:00-06:00")
+	tests := []struct {
+		t      time.Time
+		active bool
+	}{
+		{at(time.Friday, 21, 59), false},
+		{at(time.Friday, 22, 0), true},
+		{at(time.Friday, 23, 59), true},
+		{at(time.Saturday, 0, 0), true},
+		{at(time.Saturday, 5, 59), true},
+		{at(time.Saturday, 6, 0), false},
+		{at(time.Saturday, 22, 30), false},
+		// The early hours of Friday belong to Thursday night
+		{at(time.Friday, 5, 0), false},
+	}
+	for _, tt := range tests {
+		if got := s.active(tt.t); got != tt.active {
+			t.Errorf("active at %s = %v, want %v", tt.t.Format("Mon 15:04"), got, tt.active)
+		}
+	}
+}
+
+func TestScheduleWeekdayRanges(t *testing.T) {
+	tests := []struct {
+		days   string
+		active []time.Weekday
+	}{
+		{"mon-fri", []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}},
+		{"fri-mon", []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday}},
+		{"sat,sun", []time.Weekday{time.Saturday, time.Sunday}},
+		{"mon-tue,thu", []time.Weekday{time.Monday, time.Tuesday, time.Thursday}},
+		{"WED", []time.Weekday{time.Wednesday}},
+	}
+	for _, tt := range tests {
+		s := mustSchedule(t, "days="+tt.days)
+		want := make(map[time.Weekday]bool)
+		for _, d := range tt.active {
+			want[d] = true
+		}
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if got := s.active(at(d, 12, 0)); got != want[d] {
+				t.Errorf("days=%s: active on %v = %v, want %v", tt.days, d, got, want[d])
+			}
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, options := range []string{
+		"days=mon-xyz",
+		"hours=09:00-09:00",
+		"hours=25:00-26:00",
+		"hours=9-17",
+		"tz=Nowhere/Invalid",
+		"weeks=1",
+	} {
+		if _, err := parseSchedule(strings.Fields(options)); err == nil {
+			t.Errorf("parseSchedule(%q) succeeded, want an error", options)
+		}
+	}
+}
+
+func TestScheduledRuleFollowsClock(t *testing.T) {
+	bs := newTestBlockedSet(t, "||social.example^ days=mon-fri hours=09:00-17:00 tz=UTC")
+	now := at(time.Monday, 8, 59)
+	bs.SetClock(func() time.Time { return now })
+
+	steps := []struct {
+		now     time.Time
+		blocked bool
+	}{
+		{at(time.Monday, 8, 59), false},
+		{at(time.Monday, 9, 0), true},
+		{at(time.Monday, 16, 59), true},
+		{at(time.Monday, 17, 0), false},
+		{at(time.Friday, 12, 0), true},
+		{at(time.Saturday, 12, 0), false},
+	}
+	for _, step := range steps {
+		now = step.now
+		if got, _ := bs.Match("www.social.example"); got != step.blocked {
+			t.Errorf("blocked at %s = %v, want %v", now.Format("Mon 15:04"), got, step.blocked)
+		}
+	}
+}
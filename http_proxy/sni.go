@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// errClientHelloRead stops the TLS handshake once the ClientHello is read
+var errClientHelloRead = errors.New("client hello read")
+
+// tlsAccessDenied is a fatal TLS alert record (access_denied), sent to a
+// client whose tunnel is rejected after the CONNECT was accepted
+var tlsAccessDenied = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x31}
+
+// helloConn is a read-only net.Conn over the bytes of a ClientHello, for
+// letting crypto/tls parse it without taking over the connection
+type helloConn struct {
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c helloConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c helloConn) Close() error                       { return nil }
+func (c helloConn) LocalAddr() net.Addr                { return nil }
+func (c helloConn) RemoteAddr() net.Addr               { return nil }
+func (c helloConn) SetDeadline(t time.Time) error      { return nil }
+func (c helloConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c helloConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// readClientHello reads the TLS ClientHello a client sends first on a tunnel
+// and returns the server name (SNI) it asks for, which is empty when the
+// client sent none. It also returns every byte read from r, which still has
+// to be relayed to the destination. TLS is not terminated: the handshake is
+// abandoned as soon as the ClientHello is parsed
+func readClientHello(r io.Reader) (string, []byte, error) {
+	var read bytes.Buffer
+	var serverName string
+	server := tls.Server(helloConn{r: io.TeeReader(r, &read)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	})
+	err := server.Handshake()
+	if !errors.Is(err, errClientHelloRead) {
+		return "", read.Bytes(), err
+	}
+	return serverName, read.Bytes(), nil
+}
+
+// tunnelReader is the client side of a tunnel after its first bytes were
+// read to inspect them: the bytes already read, then the rest of the stream
+type tunnelReader struct {
+	io.Reader
+	io.Closer
+}
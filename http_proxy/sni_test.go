@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// openTunnel returns the proxy side of a tunnel after the client started it
+// by calling start with its side of the connection
+func openTunnel(t *testing.T, start func(client net.Conn)) net.Conn {
+	t.Helper()
+	proxySide, client := net.Pipe()
+	t.Cleanup(func() {
+		proxySide.Close()
+		client.Close()
+	})
+	go start(client)
+	return proxySide
+}
+
+// helloFor starts a TLS handshake asking for serverName, or for no server
+// name when it is empty
+func helloFor(serverName string) func(net.Conn) {
+	return func(client net.Conn) {
+		tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}
+}
+
+// connectRequest returns a CONNECT request for hostport as the proxy gets it
+func connectRequest(t *testing.T, hostport string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest("CONNECT", "http://"+hostport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "192.0.2.1:50000"
+	return req
+}
+
+func TestCheckTunnelSNI(t *testing.T) {
+	p := newTestProxy(t)
+	p.blockedSet = newTestBlockedSet(t, "||blocked.example^")
+
+	tests := []struct {
+		name    string
+		connect string
+		start   func(net.Conn)
+		ok      bool
+	}{
+		{"allowed server name", "allowed.example:443", helloFor("allowed.example"), true},
+		{"blocked server name behind an address", "203.0.113.7:443", helloFor("www.blocked.example"), false},
+		{"server name differing from the host", "allowed.example:443", helloFor("other.example"), false},
+		{"no server name", "203.0.113.7:443", helloFor(""), true},
+		{"not TLS", "203.0.113.7:22", func(c net.Conn) { io.WriteString(c, "SSH-2.0-OpenSSH_9.6\r\n") }, true},
+		{"broken ClientHello", "allowed.example:443", func(c net.Conn) { c.Write([]byte{0x16, 0x03, 0x01, 0x00, 0x05, 0xff, 0xff, 0xff, 0xff, 0xff}) }, false},
+	}
+	for _, tt := range tests {
+		conn := openTunnel(t, tt.start)
+		r := bufio.NewReader(conn)
+		source, ok := p.checkTunnelSNI(conn, r, connectRequest(t, tt.connect), "", nil, "default")
+		if ok != tt.ok {
+			t.Errorf("%s: tunnel allowed %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		// What the client sent first is still relayed, in full
+		first := make([]byte, 5)
+		if _, err := io.ReadFull(source, first); err != nil {
+			t.Errorf("%s: reading the tunnel: %v", tt.name, err)
+			continue
+		}
+		if tt.name == "not TLS" {
+			if !bytes.Equal(first, []byte("SSH-2")) {
+				t.Errorf("%s: tunnel starts with %q, want the client's bytes", tt.name, first)
+			}
+		} else if first[0] != 0x16 {
+			t.Errorf("%s: tunnel starts with %x, want the ClientHello", tt.name, first)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// HostStats counts how well the cache is doing, for one host or overall
+type HostStats struct {
+	Hits            int64   `json:"hits"`                // Fresh responses served from the cache
+	StaleHits       int64   `json:"stale_hits"`          // Stale responses served while offline
+	PeerHits        int64   `json:"peer_hits"`           // Local misses answered by a sibling proxy
+	Misses          int64   `json:"misses"`              // GET requests the cache could not answer
+	Replacements    int64   `json:"replacements"`        // Cached responses overwritten by a newer copy
+	NotModified     int64   `json:"not_modified"`        // 304 responses from the origin
+	Evictions       int64   `json:"evictions,omitempty"` // Entries evicted to make room; only the LRU cache evicts
+	BytesFromCache  int64   `json:"bytes_from_cache"`    // Body bytes served from the cache
+	BytesFromPeers  int64   `json:"bytes_from_peers"`    // Body bytes served from sibling proxies
+	BytesFromOrigin int64   `json:"bytes_from_origin"`   // Body bytes served from origin servers
+	Objects         int     `json:"objects"`             // Entries currently cached
+	HitRatio        float64 `json:"hit_ratio"`           // (Hits + StaleHits) / lookups
+}
+
+// CacheStats is a snapshot of the cache statistics, overall and per host
+type CacheStats struct {
+	HostStats
+	DiskBytes int64                 `json:"disk_bytes"` // Bytes used by metadata records and the bodies they refer to
+	Dedup     DedupStats            `json:"dedup"`
+	Hosts     map[string]*HostStats `json:"hosts"`
+}
+
+// cacheStats accumulates the counters of an HTTPCache since startup
+// The number of cached objects and the size of their records are kept up
+// to date as records are written and removed, so reading the statistics
+// never has to walk the cache directory
+type cacheStats struct {
+	mu          sync.Mutex
+	total       HostStats
+	hosts       map[string]*HostStats
+	records     map[string]storedRecord // Metadata records on disk, by cache key
+	recordBytes int64                   // Total size of the metadata records
+}
+
+// storedRecord is what the statistics remember about one metadata record
+type storedRecord struct {
+	host string
+	size int64
+}
+
+func newCacheStats() *cacheStats {
+	return &cacheStats{
+		hosts:   make(map[string]*HostStats),
+		records: make(map[string]storedRecord),
+	}
+}
+
+// host returns the counters of host, creating them on first use
+// The caller must hold s.mu
+func (s *cacheStats) host(host string) *HostStats {
+	h, ok := s.hosts[host]
+	if !ok {
+		h = &HostStats{}
+		s.hosts[host] = h
+	}
+	return h
+}
+
+// add applies fn to the totals and to the counters of host
+func (s *cacheStats) add(host string, fn func(h *HostStats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn(s.host(host))
+	fn(&s.total)
+}
+
+// recordStored counts the metadata record of size bytes written under key
+// for a URL on host, replacing any record counted under key before
+func (s *cacheStats) recordStored(key, host string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.forget(key)
+	s.records[key] = storedRecord{host: host, size: size}
+	s.recordBytes += size
+	s.host(host).Objects++
+	s.total.Objects++
+}
+
+// recordRemoved stops counting the metadata record stored under key
+func (s *cacheStats) recordRemoved(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.forget(key)
+}
+
+// forget drops the record under key from the counts, if it was counted
+// The caller must hold s.mu
+func (s *cacheStats) forget(key string) {
+	r, ok := s.records[key]
+	if !ok {
+		return
+	}
+	delete(s.records, key)
+	s.recordBytes -= r.size
+	s.host(r.host).Objects--
+	s.total.Objects--
+}
+
+// loadRecords counts the metadata records already stored in cacheDir
+// It is called once at startup, before the cache is in use
+func (s *cacheStats) loadRecords(cacheDir string) {
+	files, err := os.ReadDir(cacheDir)
+	if err != nil {
+		log.Printf("Error reading cache directory: %v", err)
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(cacheDir, f.Name()))
+		if err != nil {
+			continue
+		}
+		entry, err := decodeCacheEntry(data)
+		if err != nil {
+			continue
+		}
+		s.recordStored(f.Name(), hostOf(entry.URL), info.Size())
+	}
+}
+
+// recordHit counts a response of n body bytes served from the cache
+func (s *cacheStats) recordHit(host string, n int64, stale bool) {
+	s.add(host, func(h *HostStats) {
+		if stale {
+			h.StaleHits++
+		} else {
+			h.Hits++
+		}
+		h.BytesFromCache += n
+	})
+}
+
+// recordMissServed turns a miss already counted for host into a hit of n
+// body bytes, for a request the cache answered after all, as when the
+// origin turned out to be unreachable
+func (s *cacheStats) recordMissServed(host string, n int64, stale bool) {
+	s.add(host, func(h *HostStats) {
+		h.Misses--
+		if stale {
+			h.StaleHits++
+		} else {
+			h.Hits++
+		}
+		h.BytesFromCache += n
+	})
+}
+
+// recordPeerHit counts a response of n body bytes served by a sibling proxy
+func (s *cacheStats) recordPeerHit(host string, n int64) {
+	s.add(host, func(h *HostStats) {
+		h.PeerHits++
+		h.BytesFromPeers += n
+	})
+}
+
+// recordMiss counts a GET request the cache could not answer
+func (s *cacheStats) recordMiss(host string) {
+	s.add(host, func(h *HostStats) { h.Misses++ })
+}
+
+// recordOrigin counts a response of n body bytes served from the origin
+func (s *cacheStats) recordOrigin(host string, n int64, status int) {
+	s.add(host, func(h *HostStats) {
+		if status == 304 {
+			h.NotModified++
+		}
+		h.BytesFromOrigin += n
+	})
+}
+
+// recordReplacement counts a cached response overwritten by a newer copy
+func (s *cacheStats) recordReplacement(host string) {
+	s.add(host, func(h *HostStats) { h.Replacements++ })
+}
+
+// recordEviction counts an entry evicted to make room for another
+func (s *cacheStats) recordEviction(host string) {
+	s.add(host, func(h *HostStats) { h.Evictions++ })
+}
+
+// hostOf returns the host name of a cached URL
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// hitRatio computes the share of lookups answered from the cache
+func (h *HostStats) hitRatio() float64 {
+	lookups := h.Hits + h.StaleHits + h.Misses
+	if lookups == 0 {
+		return 0
+	}
+	return float64(h.Hits+h.StaleHits) / float64(lookups)
+}
+
+// Stats returns the cache counters, with the number of cached objects per
+// host and the disk usage of the records and the bodies they refer to
+func (c *HTTPCache) Stats() CacheStats {
+	c.stats.mu.Lock()
+	snapshot := CacheStats{HostStats: c.stats.total, Hosts: make(map[string]*HostStats)}
+	for host, h := range c.stats.hosts {
+		copied := *h
+		snapshot.Hosts[host] = &copied
+	}
+	snapshot.DiskBytes = c.stats.recordBytes
+	c.stats.mu.Unlock()
+
+	snapshot.HitRatio = snapshot.hitRatio()
+	for _, h := range snapshot.Hosts {
+		h.HitRatio = h.hitRatio()
+	}
+	snapshot.Dedup = c.blobs.stats()
+	snapshot.DiskBytes += snapshot.Dedup.StoredBytes
+	return snapshot
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// urlPattern matches URLs by host and optional path, as written at the
+// start of a line of the cache policy and safe search rules files
+type urlPattern struct {
+	pattern     string // The pattern as written in the rules file
+	host        string // Host name, or the domain after "*." when wildcard is set
+	wildcard    bool   // Whether the pattern matches any subdomain of host
+	pathPattern string // Path glob; a trailing '*' matches any suffix
+}
+
+// parseURLPattern parses a host name, optionally prefixed with "*." to
+// match its subdomains, optionally followed by a path glob, e.g.
+// *.cdn.example.com/static/*
+func parseURLPattern(pattern string) (urlPattern, error) {
+	p := urlPattern{pattern: pattern}
+	host := strings.ToLower(pattern)
+	if i := strings.Index(host, "/"); i >= 0 {
+		host, p.pathPattern = host[:i], pattern[i:]
+		if _, err := path.Match(p.pathPattern, "/"); err != nil {
+			return p, fmt.Errorf("invalid path pattern %q", p.pathPattern)
+		}
+	}
+	if strings.HasPrefix(host, "*.") {
+		host, p.wildcard = host[2:], true
+	}
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || strings.Contains(host, "*") {
+		return p, fmt.Errorf("invalid host pattern %q", pattern)
+	}
+	p.host = host
+	return p, nil
+}
+
+// matches reports whether u matches the pattern. Host names are compared
+// in lower case, without a trailing dot, and paths once "//", "." and ".."
+// are resolved, see cleanPath
+func (p *urlPattern) matches(u *url.URL) bool {
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if p.wildcard {
+		if !strings.HasSuffix(host, "."+p.host) {
+			return false
+		}
+	} else if host != p.host {
+		return false
+	}
+	return p.pathPattern == "" || matchPath(p.pathPattern, cleanPath(u.Path))
+}
+
+// matchPath matches a URL path against a glob. A trailing '*' matches any
+// remainder, including further '/'-separated segments
+func matchPath(pattern, p string) bool {
+	if strings.HasSuffix(pattern, "*") && !strings.HasSuffix(pattern, `\*`) {
+		prefix := strings.TrimSuffix(pattern, "*")
+		if len(p) < len(prefix) {
+			return false
+		}
+		matched, _ := path.Match(prefix, p[:len(prefix)])
+		return matched
+	}
+	matched, _ := path.Match(pattern, p)
+	return matched
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestURLPatternMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		url     string
+		want    bool
+	}{
+		{"example.com", "http://example.com/", true},
+		{"example.com", "http://EXAMPLE.com./x", true},
+		{"example.com.", "http://example.com/x", true},
+		{"example.com", "http://www.example.com/", false},
+		{"*.example.com", "http://www.example.com./", true},
+		{"*.example.com", "http://a.b.example.com/", true},
+		{"*.example.com", "http://example.com/", false},
+		{"*.example.com", "http://notexample.com/", false},
+		{"example.com/static/*", "http://example.com/static/a/b.css", true},
+		{"example.com/static/*", "http://example.com./static/a.css", true},
+		{"example.com/static/*", "http://example.com//static/a.css", true},
+		{"example.com/static/*", "http://example.com/x/../static/a.css", true},
+		{"example.com/static/*", "http://example.com/other/a.css", false},
+		{"example.com/*.js", "http://example.com/app.js", true},
+		{"example.com/*.js", "http://example.com/app.css", false},
+	}
+	for _, tt := range tests {
+		p, err := parseURLPattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("parseURLPattern(%q): %v", tt.pattern, err)
+		}
+		u, _ := url.Parse(tt.url)
+		if got := p.matches(u); got != tt.want {
+			t.Errorf("%s matches %s = %v, want %v", tt.pattern, tt.url, got, tt.want)
+		}
+	}
+
+	for _, pattern := range []string{"", "*.", ".", "*.*.example.com", "exa*mple.com", "example.com/[a"} {
+		if _, err := parseURLPattern(pattern); err == nil {
+			t.Errorf("parseURLPattern(%q) succeeded, want an error", pattern)
+		}
+	}
+}
+
+func TestCachePolicyMatchesTrailingDot(t *testing.T) {
+	rule, err := parseCachePolicy([]string{"*.cdn.example/static/*", "min-ttl=60"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := &cachePolicies{rules: []*cachePolicy{rule}}
+	for _, rawURL := range []string{"http://img.cdn.example/static/a.png", "http://IMG.cdn.example./static/a.png"} {
+		u, _ := url.Parse(rawURL)
+		if cp.match(u) != rule {
+			t.Errorf("%s does not match the policy for *.cdn.example/static/*", rawURL)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warmResult records what happened to one URL during a cache warm-up
+type warmResult struct {
+	URL     string `json:"url"`
+	Outcome string `json:"outcome"` // "stored", "skipped" or "failed"
+	Reason  string `json:"reason,omitempty"`
+}
+
+// warmReport summarizes a cache warm-up
+type warmReport struct {
+	Stored  int          `json:"stored"`
+	Skipped int          `json:"skipped"`
+	Failed  int          `json:"failed"`
+	Results []warmResult `json:"results"`
+}
+
+// sitemap holds the parts of a sitemap.xml we need. A <urlset> lists pages
+// and a <sitemapindex> lists further sitemaps; both keep the address in <loc>
+type sitemap struct {
+	URLs     []string `xml:"url>loc"`
+	Sitemaps []string `xml:"sitemap>loc"`
+}
+
+// readWarmSource reads a URL list or sitemap from a local file or, when src
+// starts with http:// or https://, from the network. Gzipped sitemaps are
+// decompressed. Sitemaps on the network are fetched like the pages they
+// list: not from blocked hosts, and through the transport that refuses
+// blocked addresses
+func (p *forwardProxy) readWarmSource(src string) ([]byte, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		var req *http.Request
+		req, err = http.NewRequest("GET", src, nil)
+		if err != nil {
+			return nil, err
+		}
+		if blocked, _ := p.blockedSet.MatchRequest(req, nil); blocked {
+			return nil, fmt.Errorf("fetching %s: blocked", src)
+		}
+		client := &http.Client{Transport: p.transport(nil)}
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: %s", src, resp.Status)
+		}
+		data, err = io.ReadAll(resp.Body)
+	} else {
+		data, err = os.ReadFile(src)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Sitemaps are commonly served as sitemap.xml.gz
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	}
+	return data, nil
+}
+
+// parseWarmURLs extracts the URLs to warm from data, which is either a
+// sitemap.xml or a plain list with one URL per line. In a list, blank lines
+// and lines starting with '#' are ignored. Sitemap indexes are followed one
+// level deep
+func (p *forwardProxy) parseWarmURLs(data []byte) ([]string, error) {
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("<")) {
+		var sm sitemap
+		if err := xml.Unmarshal(trimmed, &sm); err != nil {
+			return nil, fmt.Errorf("parsing sitemap: %v", err)
+		}
+		urls := trimURLs(sm.URLs)
+		for _, child := range trimURLs(sm.Sitemaps) {
+			childData, err := p.readWarmSource(child)
+			if err != nil {
+				log.Printf("Skipping sitemap %s: %v\n", child, err)
+				continue
+			}
+			var childMap sitemap
+			if err := xml.Unmarshal(childData, &childMap); err != nil {
+				log.Printf("Skipping sitemap %s: %v\n", child, err)
+				continue
+			}
+			urls = append(urls, trimURLs(childMap.URLs)...)
+		}
+		return urls, nil
+	}
+
+	var urls []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
+
+// trimURLs strips the surrounding whitespace sitemaps often leave in <loc>
+func trimURLs(urls []string) []string {
+	for i, u := range urls {
+		urls[i] = strings.TrimSpace(u)
+	}
+	return urls
+}
+
+// warmCache fetches every URL through the proxy's own fetch path so that
+// cacheable responses are stored, as if a client had requested them
+// At most concurrency fetches run at once, and at most rate fetches are
+// started per second (0 means unlimited). URLs that are blocked, not
+// http, or already fresh in the cache are skipped
+func (p *forwardProxy) warmCache(urls []string, concurrency int, rate float64) warmReport {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	results := make([]warmResult, len(urls))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		if tick != nil {
+			<-tick
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = p.warmURL(u)
+		}(i, u)
+	}
+	wg.Wait()
+
+	report := warmReport{Results: results}
+	for _, r := range results {
+		switch r.Outcome {
+		case "stored":
+			report.Stored++
+		case "skipped":
+			report.Skipped++
+		default:
+			report.Failed++
+		}
+	}
+	log.Printf("Cache warm-up: %d stored, %d skipped, %d failed\n", report.Stored, report.Skipped, report.Failed)
+	return report
+}
+
+// warmURL fetches a single URL for warmCache
+func (p *forwardProxy) warmURL(u string) warmResult {
+	result := warmResult{URL: u, Outcome: "failed"}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		result.Reason = err.Error()
+		return result
+	}
+	if req.URL.Scheme != "http" {
+		result.Outcome, result.Reason = "skipped", "unsupported protocol scheme "+req.URL.Scheme
+		return result
+	}
+	if blocked, _ := p.blockedSet.MatchRequest(req, nil); blocked {
+		result.Outcome, result.Reason = "skipped", "blocked"
+		return result
+	}
+	// Cache the page under the URL clients are rewritten to
+	p.safeSearch.rewrite(req)
+	if _, found := p.cache.Get(p.policies.match(req.URL).keyRequest(req)); found {
+		result.Outcome, result.Reason = "skipped", "already cached"
+		return result
+	}
+	if p.offline.Offline() {
+		result.Reason = "proxy is offline"
+		return result
+	}
+
+	resp, stored, err := p.fetch(req, nil)
+	if err != nil {
+		result.Reason = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case stored:
+		result.Outcome = "stored"
+	case resp.StatusCode >= 400:
+		result.Reason = resp.Status
+	default:
+		result.Outcome, result.Reason = "skipped", "not cacheable"
+	}
+	return result
+}
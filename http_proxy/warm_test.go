@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newSitemapOrigin serves a sitemap index at /sitemap.xml pointing to a
+// child sitemap that lists /page, which is cacheable
+func newSitemapOrigin(t *testing.T) *httptest.Server {
+	t.Helper()
+	var origin *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sitemap.xml", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "<sitemapindex><sitemap><loc>%s/child.xml</loc></sitemap></sitemapindex>", origin.URL)
+	})
+	mux.HandleFunc("/child.xml", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "<urlset><url><loc>%s/page?q=x</loc></url></urlset>", origin.URL)
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, req.URL.RawQuery)
+	})
+	origin = httptest.NewServer(mux)
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func TestWarmAppliesSafeSearch(t *testing.T) {
+	origin := newSitemapOrigin(t)
+	p := newTestProxy(t)
+	rule, err := parseSafeSearchRule([]string{"127.0.0.1/page", "query:safe=active"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.safeSearch = &safeSearch{rules: []*safeSearchRule{rule}}
+
+	data, err := p.readWarmSource(origin.URL + "/sitemap.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls, err := p.parseWarmURLs(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 1 {
+		t.Fatalf("got URLs %v, want the page from the child sitemap", urls)
+	}
+	if report := p.warmCache(urls, 1, 0); report.Stored != 1 {
+		t.Fatalf("warm-up stored %d pages, want 1: %+v", report.Stored, report.Results)
+	}
+	if got := getBody(t, p.cache, origin.URL+"/page?q=x&safe=active"); got != "q=x&safe=active" {
+		t.Errorf("cached page was fetched with query %q, want it rewritten", got)
+	}
+}
+
+func TestWarmSitemapsFromBlockedAddresses(t *testing.T) {
+	origin := newSitemapOrigin(t)
+	p := newTestProxy(t)
+	p.blockedSet = newTestBlockedSet(t, "127.0.0.0/8")
+
+	if _, err := p.readWarmSource(origin.URL + "/sitemap.xml"); err == nil {
+		t.Fatal("sitemap fetched from a blocked address")
+	}
+
+	// A child sitemap on a blocked address is skipped as well
+	p.blockedSet = newTestBlockedSet(t)
+	data, err := p.readWarmSource(origin.URL + "/sitemap.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.blockedSet = newTestBlockedSet(t, "127.0.0.0/8")
+	if urls, err := p.parseWarmURLs(data); err != nil || len(urls) != 0 {
+		t.Errorf("got URLs %v, %v from a child sitemap on a blocked address", urls, err)
+	}
+}